@@ -0,0 +1,505 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// arithOps lists the arithmetic operators, longest first.
+var arithOps = []string{
+	"<<=", ">>=", "**", "++", "--", "<<", ">>", "<=", ">=", "==", "!=",
+	"&&", "||", "*=", "/=", "%=", "+=", "-=", "&=", "^=", "|=",
+	"+", "-", "*", "/", "%", "<", ">", "&", "^", "|", "!", "~",
+	"?", ":", "=", ",", "(", ")",
+}
+
+// arith evaluates an integer expression with C operators and precedence,
+// as used by $((...)), ((...)) and let. Variables are read and assigned
+// through the shell; a variable's value is itself evaluated as an
+// expression.
+type arith struct {
+	sh  *shell
+	src string
+	pos int
+	tok string
+	// skip is non-zero while parsing an operand that short-circuiting
+	// leaves unevaluated: no assignments or division errors happen there.
+	skip  int
+	depth int
+}
+
+// arithValue is an operand; name is set when it is a variable that can be
+// assigned to.
+type arithValue struct {
+	n    int64
+	name string
+}
+
+func (sh *shell) evalArith(expr string) (int64, error) {
+	return sh.evalArithDepth(expr, 0)
+}
+
+func (sh *shell) evalArithDepth(expr string, depth int) (int64, error) {
+	if depth > 64 {
+		return 0, fmt.Errorf("%s: expression recursion level exceeded", expr)
+	}
+	a := &arith{sh: sh, src: expr, depth: depth}
+	if err := a.next(); err != nil {
+		return 0, err
+	}
+	if a.tok == "" {
+		return 0, nil
+	}
+	v, err := a.comma()
+	if err != nil {
+		return 0, err
+	}
+	if a.tok != "" {
+		return 0, a.syntaxError()
+	}
+	return v.n, nil
+}
+
+func (a *arith) syntaxError() error {
+	rest := strings.TrimSpace(a.src[a.pos-len(a.tok):])
+	return fmt.Errorf("%s: syntax error in expression (error token is \"%s\")", strings.TrimSpace(a.src), rest)
+}
+
+// next reads the following token into a.tok; "" means end of input.
+func (a *arith) next() error {
+	for a.pos < len(a.src) && strings.IndexByte(" \t\n", a.src[a.pos]) >= 0 {
+		a.pos++
+	}
+	if a.pos >= len(a.src) {
+		a.tok = ""
+		return nil
+	}
+
+	start := a.pos
+	c := a.src[a.pos]
+	switch {
+	case isDigit(c):
+		for a.pos < len(a.src) && (isNameChar(a.src[a.pos]) || a.src[a.pos] == '#' || a.src[a.pos] == '@') {
+			a.pos++
+		}
+	case isNameStart(c):
+		for a.pos < len(a.src) && isNameChar(a.src[a.pos]) {
+			a.pos++
+		}
+	default:
+		for _, op := range arithOps {
+			if strings.HasPrefix(a.src[a.pos:], op) {
+				a.pos += len(op)
+				break
+			}
+		}
+		if a.pos == start {
+			a.pos++
+			a.tok = a.src[start:a.pos]
+			return a.syntaxError()
+		}
+	}
+	a.tok = a.src[start:a.pos]
+	return nil
+}
+
+func (a *arith) assign(name string, n int64) error {
+	if a.skip > 0 {
+		return nil
+	}
+	if name == "" {
+		return fmt.Errorf("%s: attempted assignment to non-variable", strings.TrimSpace(a.src))
+	}
+	a.sh.setVar(name, strconv.FormatInt(n, 10))
+	return nil
+}
+
+func (a *arith) comma() (arithValue, error) {
+	v, err := a.assignment()
+	for err == nil && a.tok == "," {
+		if err = a.next(); err != nil {
+			break
+		}
+		v, err = a.assignment()
+	}
+	return v, err
+}
+
+func (a *arith) assignment() (arithValue, error) {
+	v, err := a.ternary()
+	if err != nil {
+		return v, err
+	}
+
+	switch op := a.tok; op {
+	case "=", "*=", "/=", "%=", "+=", "-=", "<<=", ">>=", "&=", "^=", "|=":
+		if v.name == "" {
+			return v, fmt.Errorf("%s: attempted assignment to non-variable (error token is \"%s\")", strings.TrimSpace(a.src), op)
+		}
+		if err := a.next(); err != nil {
+			return v, err
+		}
+		rhs, err := a.assignment()
+		if err != nil {
+			return v, err
+		}
+		n := rhs.n
+		if op != "=" {
+			if n, err = a.binary(strings.TrimSuffix(op, "="), v.n, rhs.n); err != nil {
+				return v, err
+			}
+		}
+		if err := a.assign(v.name, n); err != nil {
+			return v, err
+		}
+		return arithValue{n: n}, nil
+	}
+	return v, nil
+}
+
+func (a *arith) ternary() (arithValue, error) {
+	cond, err := a.binaryLevel(0)
+	if err != nil || a.tok != "?" {
+		return cond, err
+	}
+	if err := a.next(); err != nil {
+		return cond, err
+	}
+
+	if cond.n == 0 {
+		a.skip++
+	}
+	yes, err := a.assignment()
+	if cond.n == 0 {
+		a.skip--
+	}
+	if err != nil {
+		return yes, err
+	}
+	if a.tok != ":" {
+		return yes, a.syntaxError()
+	}
+	if err := a.next(); err != nil {
+		return yes, err
+	}
+
+	if cond.n != 0 {
+		a.skip++
+	}
+	no, err := a.assignment()
+	if cond.n != 0 {
+		a.skip--
+	}
+	if err != nil {
+		return no, err
+	}
+
+	if cond.n != 0 {
+		return arithValue{n: yes.n}, nil
+	}
+	return arithValue{n: no.n}, nil
+}
+
+// binaryLevels lists the left-associative binary operators from lowest to
+// highest precedence.
+var binaryLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", ">", "<=", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (a *arith) binaryLevel(level int) (arithValue, error) {
+	if level == len(binaryLevels) {
+		return a.power()
+	}
+
+	lhs, err := a.binaryLevel(level + 1)
+	for err == nil {
+		op := a.tok
+		if !containsString(binaryLevels[level], op) {
+			break
+		}
+		if err = a.next(); err != nil {
+			break
+		}
+
+		// && and || do not evaluate their right operand when the left one
+		// decides the result.
+		shortCircuit := (op == "&&" && lhs.n == 0) || (op == "||" && lhs.n != 0)
+		if shortCircuit {
+			a.skip++
+		}
+		var rhs arithValue
+		rhs, err = a.binaryLevel(level + 1)
+		if shortCircuit {
+			a.skip--
+		}
+		if err != nil {
+			break
+		}
+
+		var n int64
+		switch {
+		case op == "&&":
+			n = boolInt(lhs.n != 0 && rhs.n != 0)
+		case op == "||":
+			n = boolInt(lhs.n != 0 || rhs.n != 0)
+		default:
+			n, err = a.binary(op, lhs.n, rhs.n)
+		}
+		lhs = arithValue{n: n}
+	}
+	return lhs, err
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (a *arith) binary(op string, x, y int64) (int64, error) {
+	switch op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/", "%":
+		if y == 0 {
+			if a.skip > 0 {
+				return 0, nil
+			}
+			return 0, fmt.Errorf("%s: division by 0", strings.TrimSpace(a.src))
+		}
+		if op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	case "**":
+		if y < 0 {
+			if a.skip > 0 {
+				return 0, nil
+			}
+			return 0, fmt.Errorf("%s: exponent less than 0", strings.TrimSpace(a.src))
+		}
+		// Square and multiply, wrapping like bash does on overflow.
+		result := int64(1)
+		for ; y > 0; y >>= 1 {
+			if y&1 == 1 {
+				result *= x
+			}
+			x *= x
+		}
+		return result, nil
+	case "<<":
+		return x << uint64(y), nil
+	case ">>":
+		return x >> uint64(y), nil
+	case "<":
+		return boolInt(x < y), nil
+	case ">":
+		return boolInt(x > y), nil
+	case "<=":
+		return boolInt(x <= y), nil
+	case ">=":
+		return boolInt(x >= y), nil
+	case "==":
+		return boolInt(x == y), nil
+	case "!=":
+		return boolInt(x != y), nil
+	case "&":
+		return x & y, nil
+	case "^":
+		return x ^ y, nil
+	case "|":
+		return x | y, nil
+	}
+	return 0, fmt.Errorf("%s: unknown operator %s", strings.TrimSpace(a.src), op)
+}
+
+// power handles the right-associative "**", which binds tighter than the
+// other binary operators but looser than unary ones.
+func (a *arith) power() (arithValue, error) {
+	base, err := a.unary()
+	if err != nil || a.tok != "**" {
+		return base, err
+	}
+	if err := a.next(); err != nil {
+		return base, err
+	}
+	exp, err := a.power()
+	if err != nil {
+		return exp, err
+	}
+	n, err := a.binary("**", base.n, exp.n)
+	return arithValue{n: n}, err
+}
+
+func (a *arith) unary() (arithValue, error) {
+	switch op := a.tok; op {
+	case "+", "-", "!", "~":
+		if err := a.next(); err != nil {
+			return arithValue{}, err
+		}
+		v, err := a.unary()
+		if err != nil {
+			return v, err
+		}
+		switch op {
+		case "-":
+			return arithValue{n: -v.n}, nil
+		case "!":
+			return arithValue{n: boolInt(v.n == 0)}, nil
+		case "~":
+			return arithValue{n: ^v.n}, nil
+		}
+		return arithValue{n: v.n}, nil
+
+	case "++", "--":
+		if err := a.next(); err != nil {
+			return arithValue{}, err
+		}
+		v, err := a.unary()
+		if err != nil {
+			return v, err
+		}
+		n := v.n + 1
+		if op == "--" {
+			n = v.n - 1
+		}
+		if err := a.assign(v.name, n); err != nil {
+			return v, err
+		}
+		return arithValue{n: n}, nil
+	}
+	return a.postfix()
+}
+
+func (a *arith) postfix() (arithValue, error) {
+	v, err := a.primary()
+	if err != nil || v.name == "" || (a.tok != "++" && a.tok != "--") {
+		return v, err
+	}
+	n := v.n + 1
+	if a.tok == "--" {
+		n = v.n - 1
+	}
+	if err := a.assign(v.name, n); err != nil {
+		return v, err
+	}
+	if err := a.next(); err != nil {
+		return v, err
+	}
+	return arithValue{n: v.n}, nil
+}
+
+func (a *arith) primary() (arithValue, error) {
+	tok := a.tok
+	switch {
+	case tok == "":
+		return arithValue{}, fmt.Errorf("%s: syntax error: operand expected", strings.TrimSpace(a.src))
+
+	case tok == "(":
+		if err := a.next(); err != nil {
+			return arithValue{}, err
+		}
+		v, err := a.comma()
+		if err != nil {
+			return v, err
+		}
+		if a.tok != ")" {
+			return v, a.syntaxError()
+		}
+		return arithValue{n: v.n}, a.next()
+
+	case isDigit(tok[0]):
+		n, err := parseArithNumber(tok)
+		if err != nil {
+			return arithValue{}, fmt.Errorf("%s: %v (error token is \"%s\")", strings.TrimSpace(a.src), err, tok)
+		}
+		return arithValue{n: n}, a.next()
+
+	case isNameStart(tok[0]):
+		v := arithValue{name: tok}
+		if a.skip == 0 {
+			value, _ := a.sh.paramValue(tok)
+			n, err := a.sh.evalArithDepth(value, a.depth+1)
+			if err != nil {
+				return v, err
+			}
+			v.n = n
+		}
+		return v, a.next()
+	}
+	return arithValue{}, a.syntaxError()
+}
+
+// parseArithNumber reads a decimal, 0x hexadecimal, leading-zero octal or
+// base#digits literal. Bases above 10 use letters, then '@' and '_', with
+// lower and upper case distinct above base 36.
+func parseArithNumber(tok string) (int64, error) {
+	base := int64(10)
+	digits := tok
+	if b, d, ok := strings.Cut(tok, "#"); ok {
+		n, err := strconv.ParseInt(b, 10, 64)
+		if err != nil || n < 2 || n > 64 {
+			return 0, fmt.Errorf("invalid arithmetic base")
+		}
+		base, digits = n, d
+	} else if strings.HasPrefix(tok, "0x") || strings.HasPrefix(tok, "0X") {
+		base, digits = 16, tok[2:]
+	} else if len(tok) > 1 && tok[0] == '0' {
+		base, digits = 8, tok[1:]
+	}
+	if digits == "" {
+		return 0, fmt.Errorf("invalid number")
+	}
+
+	var n int64
+	for i := 0; i < len(digits); i++ {
+		c := digits[i]
+		var d int64
+		switch {
+		case isDigit(c):
+			d = int64(c - '0')
+		case c >= 'a' && c <= 'z':
+			d = int64(c-'a') + 10
+		case c >= 'A' && c <= 'Z':
+			d = int64(c-'A') + 10
+			if base > 36 {
+				d += 26
+			}
+		case c == '@':
+			d = 62
+		case c == '_':
+			d = 63
+		default:
+			return 0, fmt.Errorf("invalid number")
+		}
+		if d >= base {
+			return 0, fmt.Errorf("value too great for base")
+		}
+		n = n*base + d
+	}
+	return n, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+// List is a sequence of and-or lists separated by ';' or newlines.
+type List struct {
+	Items []*AndOr
+}
+
+// AndOr is pipelines joined by "&&" and "||". Ops[i] sits between
+// Pipelines[i] and Pipelines[i+1]; both operators have equal precedence and
+// are evaluated left to right.
+type AndOr struct {
+	Pipelines []*Pipeline
+	Ops       []string
+}
+
+// Pipeline is one or more commands connected by '|'.
+type Pipeline struct {
+	Cmds []Command
+}
+
+// Command is an element of a pipeline: a simple command or a compound
+// command such as ((...)).
+type Command interface {
+	command()
+}
+
+type SimpleCommand struct {
+	Assigns []*Assign
+	Args    []*Word
+	Redirs  []*ReDirection
+}
+
+// ArithCommand is ((expr)), which succeeds when expr is non-zero.
+type ArithCommand struct {
+	Expr   *Word
+	Redirs []*ReDirection
+}
+
+// Subshell is ( list ), run in a copy of the shell so that variable and
+// directory changes do not outlive it.
+type Subshell struct {
+	List   *List
+	Redirs []*ReDirection
+}
+
+// BraceGroup is { list; }, run in the current shell with shared
+// redirections.
+type BraceGroup struct {
+	List   *List
+	Redirs []*ReDirection
+}
+
+// IfClause is if/elif/else/fi. Conds[i] guards Bodies[i]; the first is
+// the if branch and the rest are elif branches. Else may be nil.
+type IfClause struct {
+	Conds  []*List
+	Bodies []*List
+	Else   *List
+	Redirs []*ReDirection
+}
+
+// WhileClause is a while loop, or an until loop when Until is set.
+type WhileClause struct {
+	Cond   *List
+	Body   *List
+	Until  bool
+	Redirs []*ReDirection
+}
+
+// ForClause is for NAME in WORDS; do ...; done. Without "in", Words is nil
+// and the loop runs over the positional parameters.
+type ForClause struct {
+	Name   string
+	Words  []*Word
+	Body   *List
+	Redirs []*ReDirection
+}
+
+// ArithForClause is for ((init; cond; post)); do ...; done. An empty Cond
+// is true.
+type ArithForClause struct {
+	Init, Cond, Post *Word
+	Body             *List
+	Redirs           []*ReDirection
+}
+
+// CaseClause is case WORD in PATTERN) ... esac.
+type CaseClause struct {
+	Word   *Word
+	Items  []*CaseItem
+	Redirs []*ReDirection
+}
+
+// CaseItem is one PATTERN|PATTERN) LIST arm of a case. Term is ";;" to
+// stop, ";&" to run the next arm's list too, or ";;&" to go on testing the
+// following patterns.
+type CaseItem struct {
+	Patterns []*Word
+	Body     *List
+	Term     string
+}
+
+// FuncDef is NAME() BODY or function NAME BODY, where BODY is a compound
+// command. Source is the definition as written, which declare -f prints.
+type FuncDef struct {
+	Name   string
+	Body   Command
+	Source string
+}
+
+func (*SimpleCommand) command()  {}
+func (*ArithCommand) command()   {}
+func (*Subshell) command()       {}
+func (*BraceGroup) command()     {}
+func (*IfClause) command()       {}
+func (*WhileClause) command()    {}
+func (*ForClause) command()      {}
+func (*ArithForClause) command() {}
+func (*CaseClause) command()     {}
+func (*FuncDef) command()        {}
+
+// Assign is a NAME=value word preceding a command.
+type Assign struct {
+	Name  string
+	Value *Word
+}
+
+// Word is a single shell word made of adjacent parts, e.g. foo"bar"'baz'
+// is one word with three parts.
+type Word struct {
+	Parts []WordPart
+}
+
+type WordPart interface {
+	wordPart()
+}
+
+// Lit is unquoted literal text. Inside a DblQuoted it is quoted text.
+type Lit struct {
+	Value string
+}
+
+// SglQuoted is text taken verbatim. Backslash-escaped characters are stored
+// as SglQuoted too, since they expand the same way.
+type SglQuoted struct {
+	Value string
+}
+
+type DblQuoted struct {
+	Parts []WordPart
+}
+
+// ParamExp is a parameter expansion: $NAME, ${#NAME}, or ${NAME} optionally
+// followed by an operator such as ":-" and its word argument. Arg2 holds the
+// replacement of the "/" operators and the length of ":".
+type ParamExp struct {
+	Name   string
+	Length bool
+	Op     string
+	Arg    *Word
+	Arg2   *Word
+}
+
+// CmdSubst is a command substitution, $(...) or `...`.
+type CmdSubst struct {
+	List *List
+}
+
+// ProcSubst is a process substitution, <(...) or, with Out set, >(...).
+type ProcSubst struct {
+	List *List
+	Out  bool
+}
+
+// ArithExp is an arithmetic expansion, $((...)). Expr is expanded like a
+// double-quoted string before it is evaluated.
+type ArithExp struct {
+	Expr *Word
+}
+
+func (*Lit) wordPart()       {}
+func (*SglQuoted) wordPart() {}
+func (*DblQuoted) wordPart() {}
+func (*ParamExp) wordPart()  {}
+func (*CmdSubst) wordPart()  {}
+func (*ProcSubst) wordPart() {}
+func (*ArithExp) wordPart()  {}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// braceItem is one element of a word seen by brace expansion: either an
+// unquoted literal character or a whole part (quoted text, expansions)
+// that brace expansion passes through untouched.
+type braceItem struct {
+	r    rune
+	part WordPart
+}
+
+func (it braceItem) is(r rune) bool {
+	return it.part == nil && it.r == r
+}
+
+// braceExpand performs brace expansion, the first word-expansion step,
+// returning the words {a,b} and {x..y[..incr]} expand to. Only unquoted
+// braces and commas take part, so "{a,b}" and \{a,b} stay literal.
+func braceExpand(w *Word) []*Word {
+	var items []braceItem
+	hasBrace := false
+	for _, part := range w.Parts {
+		if lit, ok := part.(*Lit); ok {
+			for _, r := range lit.Value {
+				items = append(items, braceItem{r: r})
+			}
+			hasBrace = hasBrace || strings.ContainsRune(lit.Value, '{')
+		} else {
+			items = append(items, braceItem{part: part})
+		}
+	}
+	if !hasBrace {
+		return []*Word{w}
+	}
+
+	expanded := expandBraceItems(items)
+	words := make([]*Word, len(expanded))
+	for i, seq := range expanded {
+		words[i] = wordFromItems(seq)
+	}
+	return words
+}
+
+func wordFromItems(items []braceItem) *Word {
+	var b partsBuilder
+	for _, it := range items {
+		if it.part != nil {
+			b.add(it.part)
+		} else {
+			b.lit.WriteRune(it.r)
+		}
+	}
+	return &Word{Parts: b.done()}
+}
+
+func expandBraceItems(items []braceItem) [][]braceItem {
+	for open := 0; open < len(items); open++ {
+		if !items[open].is('{') {
+			continue
+		}
+		close, commas := findBraceClose(items, open)
+		if close < 0 {
+			continue
+		}
+
+		var alts [][]braceItem
+		if len(commas) > 0 {
+			start := open + 1
+			for _, comma := range commas {
+				alts = append(alts, expandBraceItems(items[start:comma])...)
+				start = comma + 1
+			}
+			alts = append(alts, expandBraceItems(items[start:close])...)
+		} else {
+			seq, ok := braceSequence(items[open+1 : close])
+			if !ok {
+				continue
+			}
+			for _, s := range seq {
+				var alt []braceItem
+				for _, r := range s {
+					alt = append(alt, braceItem{r: r})
+				}
+				alts = append(alts, alt)
+			}
+		}
+
+		prefix := items[:open]
+		var result [][]braceItem
+		for _, alt := range alts {
+			for _, suffix := range expandBraceItems(items[close+1:]) {
+				seq := make([]braceItem, 0, len(prefix)+len(alt)+len(suffix))
+				seq = append(seq, prefix...)
+				seq = append(seq, alt...)
+				seq = append(seq, suffix...)
+				result = append(result, seq)
+			}
+		}
+		return result
+	}
+	return [][]braceItem{items}
+}
+
+// findBraceClose finds the '}' matching items[open] and the top-level
+// commas between them. It returns -1 if the brace is never closed.
+func findBraceClose(items []braceItem, open int) (int, []int) {
+	depth := 0
+	var commas []int
+	for i := open; i < len(items); i++ {
+		switch {
+		case items[i].is('{'):
+			depth++
+		case items[i].is('}'):
+			depth--
+			if depth == 0 {
+				return i, commas
+			}
+		case items[i].is(',') && depth == 1:
+			commas = append(commas, i)
+		}
+	}
+	return -1, nil
+}
+
+// braceSequence expands the body of {x..y} or {x..y..incr}, where x and y
+// are both integers or both single letters. Integers written with a
+// leading zero pad every result to the same width.
+func braceSequence(body []braceItem) ([]string, bool) {
+	var sb strings.Builder
+	for _, it := range body {
+		if it.part != nil {
+			return nil, false
+		}
+		sb.WriteRune(it.r)
+	}
+	fields := strings.Split(sb.String(), "..")
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, false
+	}
+
+	incr := uint64(1)
+	if len(fields) == 3 {
+		n, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, false
+		}
+		switch {
+		case n > 0:
+			incr = uint64(n)
+		case n < 0:
+			incr = -uint64(n)
+		}
+	}
+
+	start, errStart := strconv.Atoi(fields[0])
+	end, errEnd := strconv.Atoi(fields[1])
+	if errStart == nil && errEnd == nil {
+		width := 0
+		for _, f := range fields[:2] {
+			digits := strings.TrimPrefix(f, "-")
+			if len(digits) > 1 && digits[0] == '0' && len(f) > width {
+				width = len(f)
+			}
+		}
+		var seq []string
+		for _, n := range rangeSteps(start, end, incr) {
+			s := strconv.Itoa(n)
+			if width > 0 {
+				s = padNumber(n, width)
+			}
+			seq = append(seq, s)
+		}
+		return seq, true
+	}
+
+	a, b := []rune(fields[0]), []rune(fields[1])
+	if len(a) != 1 || len(b) != 1 || !isASCIILetter(a[0]) || !isASCIILetter(b[0]) {
+		return nil, false
+	}
+	var seq []string
+	for _, n := range rangeSteps(int(a[0]), int(b[0]), incr) {
+		seq = append(seq, string(rune(n)))
+	}
+	return seq, true
+}
+
+func isASCIILetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+// rangeSteps lists start, start+incr, ... towards end, stopping at end.
+// The distance left is compared with incr before stepping, so sequences
+// near the limits of int end instead of overflowing.
+func rangeSteps(start, end int, incr uint64) []int {
+	var steps []int
+	for n := start; ; {
+		steps = append(steps, n)
+		var left uint64
+		if start <= end {
+			left = uint64(end) - uint64(n)
+		} else {
+			left = uint64(n) - uint64(end)
+		}
+		if left < incr {
+			return steps
+		}
+		if start <= end {
+			n += int(incr)
+		} else {
+			n -= int(incr)
+		}
+	}
+}
+
+// padNumber formats n zero-padded to width characters, sign included.
+func padNumber(n, width int) string {
+	s := strconv.Itoa(n)
+	sign := ""
+	if n < 0 {
+		sign, s = "-", s[1:]
+	}
+	if pad := width - len(sign) - len(s); pad > 0 {
+		s = strings.Repeat("0", pad) + s
+	}
+	return sign + s
+}
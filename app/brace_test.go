@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestBraceSequenceLimits(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`echo {1..10..3} {10..1..3} {a..e..2}`, "1 4 7 10 10 7 4 1 a c e\n"},
+		{`echo {9223372036854775806..9223372036854775807}`, "9223372036854775806 9223372036854775807\n"},
+		{`echo {-9223372036854775807..-9223372036854775808}`, "-9223372036854775807 -9223372036854775808\n"},
+		{`echo {1..3..9223372036854775807}`, "1\n"},
+		{`echo {1..2..-9223372036854775808}`, "1\n"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
@@ -439,7 +439,9 @@ func completeArguement(lineStr string, words []string) ([][]rune, int) {
 		}
 	}
 	
-	entries, err := os.ReadDir(searchDir)
+	entries, err := readDirMatching(searchDir, func(name string) bool {
+		return strings.HasPrefix(name, partialBase)
+	})
 	if err != nil {
 		return nil, 0
 	}
@@ -447,18 +449,16 @@ func completeArguement(lineStr string, words []string) ([][]rune, int) {
 	candidates := []string{}
 	for _, entry := range entries {
 		name := entry.Name()
-		if strings.HasPrefix(name, partialBase) {
-			fullPath := filepath.Join(searchDir, name)
-			
-			if entry.IsDir() {
-				fullPath += string(os.PathSeparator)
-			}
-			
-			if filepath.IsAbs(partial) || partial != partialBase {
-				candidates = append(candidates, fullPath[len(searchDir)-1:])
-			} else {
-				candidates = append(candidates, name)
-			}
+		fullPath := filepath.Join(searchDir, name)
+		
+		if entry.IsDir() {
+			fullPath += string(os.PathSeparator)
+		}
+		
+		if filepath.IsAbs(partial) || partial != partialBase {
+			candidates = append(candidates, fullPath[len(searchDir)-1:])
+		} else {
+			candidates = append(candidates, name)
 		}
 	}
 	
@@ -470,6 +470,23 @@ func completeArguement(lineStr string, words []string) ([][]rune, int) {
 	return formatCompletionResults(prefix, candidates)
 }
 
+// readDirMatching returns the entries of dir whose names satisfy match, in
+// name order. It is shared by argument completion and globbing.
+func readDirMatching(dir string, match func(name string) bool) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	
+	matched := entries[:0]
+	for _, entry := range entries {
+		if match(entry.Name()) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched, nil
+}
+
 func formatCompletionResults(prefix string, candidates []string) ([][]rune, int) {
 	if len(candidates) == 1 {
 		completion := candidates[0][len(prefix):]
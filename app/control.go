@@ -0,0 +1,198 @@
+package main
+
+import "fmt"
+
+// loopBody runs one iteration of a loop body and reports whether the loop
+// should stop, along with the error to return from the loop if it does. A
+// break or continue aimed at an outer loop is passed on with its count
+// reduced.
+func (sh *shell) loopBody(body *List, s streams) (bool, error) {
+	err := sh.executeList(body, s)
+	ctl, ok := err.(loopControl)
+	switch {
+	case !ok:
+		return unwinds(err), err
+	case ctl.n > 1:
+		ctl.n--
+		return true, ctl
+	case ctl.cont:
+		return false, nil
+	}
+	return true, nil
+}
+
+func (sh *shell) executeIf(cmd *IfClause, s streams) error {
+	for i, cond := range cmd.Conds {
+		err := sh.executeList(cond, s)
+		if unwinds(err) {
+			return err
+		}
+		if err == nil {
+			return sh.executeList(cmd.Bodies[i], s)
+		}
+	}
+	if cmd.Else != nil {
+		return sh.executeList(cmd.Else, s)
+	}
+	return nil
+}
+
+// executeWhile runs the body while the condition succeeds, or for until,
+// while it fails. The result is that of the last body run.
+func (sh *shell) executeWhile(cmd *WhileClause, s streams) error {
+	sh.loopDepth++
+	defer func() { sh.loopDepth-- }()
+
+	var result error
+	for {
+		err := sh.executeList(cmd.Cond, s)
+		if unwinds(err) {
+			if ctl, ok := err.(loopControl); ok {
+				// break or continue in the condition acts on this loop.
+				if ctl.n > 1 {
+					ctl.n--
+					return ctl
+				}
+				if ctl.cont {
+					continue
+				}
+				return result
+			}
+			return err
+		}
+		if (err == nil) == cmd.Until {
+			return result
+		}
+		stop, err := sh.loopBody(cmd.Body, s)
+		if stop {
+			return err
+		}
+		result = err
+	}
+}
+
+func (sh *shell) executeFor(cmd *ForClause, s streams) error {
+	sh.io = s
+	defer sh.beginProcSubsts()()
+	values := sh.params
+	if cmd.Words != nil {
+		var err error
+		if values, err = sh.expandWords(cmd.Words); err != nil {
+			fmt.Fprintln(s.stderr, err)
+			return exitStatus(1)
+		}
+	}
+	s = sh.procSubstStreams(s)
+
+	sh.loopDepth++
+	defer func() { sh.loopDepth-- }()
+
+	var result error
+	for _, value := range values {
+		sh.setVar(cmd.Name, value)
+		stop, err := sh.loopBody(cmd.Body, s)
+		if stop {
+			return err
+		}
+		result = err
+	}
+	return result
+}
+
+// executeArithFor runs for ((init; cond; post)). An arithmetic error ends
+// the loop with status 1.
+func (sh *shell) executeArithFor(cmd *ArithForClause, s streams) error {
+	sh.io = s
+	eval := func(w *Word) (int64, error) {
+		n, err := sh.evalArithWord(w)
+		if err != nil {
+			fmt.Fprintln(s.stderr, err)
+			return 0, exitStatus(1)
+		}
+		return n, nil
+	}
+
+	sh.loopDepth++
+	defer func() { sh.loopDepth-- }()
+
+	if _, err := eval(cmd.Init); err != nil {
+		return err
+	}
+	var result error
+	for {
+		if len(cmd.Cond.Parts) > 0 {
+			n, err := eval(cmd.Cond)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return result
+			}
+		}
+		stop, err := sh.loopBody(cmd.Body, s)
+		if stop {
+			return err
+		}
+		result = err
+		if _, err := eval(cmd.Post); err != nil {
+			return err
+		}
+	}
+}
+
+// executeCase runs the list of the first arm with a pattern matching the
+// word. ";&" goes on to run the next arm's list and ";;&" goes on testing
+// the arms after it.
+func (sh *shell) executeCase(cmd *CaseClause, s streams) error {
+	sh.io = s
+	defer sh.beginProcSubsts()()
+	word, err := sh.expandWord(cmd.Word)
+	if err != nil {
+		fmt.Fprintln(s.stderr, err)
+		return exitStatus(1)
+	}
+	s = sh.procSubstStreams(s)
+
+	var result error
+	fallthru := false
+	for _, item := range cmd.Items {
+		if !fallthru {
+			matched, err := sh.caseMatches(item, word)
+			if err != nil {
+				fmt.Fprintln(s.stderr, err)
+				return exitStatus(1)
+			}
+			if !matched {
+				continue
+			}
+		}
+		if item.Body != nil {
+			result = sh.executeList(item.Body, s)
+			if unwinds(result) {
+				return result
+			}
+		}
+		switch item.Term {
+		case ";&":
+			fallthru = true
+		case ";;&":
+			fallthru = false
+		default:
+			return result
+		}
+	}
+	return result
+}
+
+func (sh *shell) caseMatches(item *CaseItem, word string) (bool, error) {
+	for _, w := range item.Patterns {
+		pat, err := sh.expandPattern(w)
+		if err != nil {
+			return false, err
+		}
+		if pat.match(word) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
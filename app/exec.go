@@ -0,0 +1,534 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// streams are the open file descriptors a command runs with: the three
+// standard ones and any others set up by redirections. A nil file is a
+// closed descriptor.
+type streams struct {
+	stdin  *os.File
+	stdout *os.File
+	stderr *os.File
+	extra  map[int]*os.File
+}
+
+func stdStreams() streams {
+	return streams{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}
+}
+
+// fd returns the file open as descriptor n, or nil if it is closed.
+func (s streams) fd(n int) *os.File {
+	switch n {
+	case 0:
+		return s.stdin
+	case 1:
+		return s.stdout
+	case 2:
+		return s.stderr
+	}
+	return s.extra[n]
+}
+
+// withFd returns a copy of s with descriptor n set to f, or closed when f
+// is nil. The extra descriptors are copied so s itself is unchanged.
+func (s streams) withFd(n int, f *os.File) streams {
+	switch n {
+	case 0:
+		s.stdin = f
+	case 1:
+		s.stdout = f
+	case 2:
+		s.stderr = f
+	default:
+		extra := make(map[int]*os.File, len(s.extra)+1)
+		for fd, file := range s.extra {
+			extra[fd] = file
+		}
+		if f == nil {
+			delete(extra, n)
+		} else {
+			extra[n] = f
+		}
+		s.extra = extra
+	}
+	return s
+}
+
+// withChanges returns a copy of s with every descriptor that differs
+// between old and new set as it is in new.
+func (s streams) withChanges(old, new streams) streams {
+	for fd := 0; fd < 3; fd++ {
+		if old.fd(fd) != new.fd(fd) {
+			s = s.withFd(fd, new.fd(fd))
+		}
+	}
+	for fd, f := range old.extra {
+		if new.extra[fd] != f {
+			s = s.withFd(fd, new.extra[fd])
+		}
+	}
+	for fd, f := range new.extra {
+		if old.extra[fd] != f {
+			s = s.withFd(fd, f)
+		}
+	}
+	return s
+}
+
+// extraFiles lists descriptors 3 and up in the form exec.Cmd.ExtraFiles
+// expects, with nil for the gaps.
+func (s streams) extraFiles() []*os.File {
+	max := 2
+	for fd := range s.extra {
+		if fd > max {
+			max = fd
+		}
+	}
+	files := make([]*os.File, max-2)
+	for fd, file := range s.extra {
+		files[fd-3] = file
+	}
+	return files
+}
+
+// exitStatus is the error for a command that ran but finished with a
+// non-zero status.
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// shellExit is returned by the exit builtin and unwinds execution up to the
+// shell that should terminate.
+type shellExit int
+
+func (e shellExit) Error() string {
+	return fmt.Sprintf("exit %d", int(e))
+}
+
+// loopControl is returned by break and continue and unwinds execution up
+// to the n-th enclosing loop.
+type loopControl struct {
+	n    int
+	cont bool
+}
+
+func (e loopControl) Error() string {
+	if e.cont {
+		return fmt.Sprintf("continue %d", e.n)
+	}
+	return fmt.Sprintf("break %d", e.n)
+}
+
+// funcReturn is returned by the return builtin and unwinds execution up to
+// the function call, whose status it becomes.
+type funcReturn int
+
+func (e funcReturn) Error() string {
+	return fmt.Sprintf("return %d", int(e))
+}
+
+// unwinds reports whether err is control flow, such as exit or break, that
+// stops every enclosing list until something handles it.
+func unwinds(err error) bool {
+	switch err.(type) {
+	case shellExit, loopControl, funcReturn:
+		return true
+	}
+	return false
+}
+
+// statusOf converts a command's error into its exit status.
+func statusOf(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var status exitStatus
+	if errors.As(err, &status) {
+		return int(status)
+	}
+	var exit shellExit
+	if errors.As(err, &exit) {
+		return int(exit)
+	}
+	if ret, ok := err.(funcReturn); ok {
+		return int(ret)
+	}
+	if _, ok := err.(loopControl); ok {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+func (sh *shell) executeList(list *List, s streams) error {
+	var err error
+	files, gen := sh.files, sh.filesGen
+	for _, item := range list.Items {
+		err = sh.executeAndOr(item, s)
+		if unwinds(err) {
+			return err
+		}
+		if sh.filesGen != gen {
+			// exec changed the shell's descriptors for the commands that
+			// follow.
+			s = s.withChanges(files, sh.files)
+			files, gen = sh.files, sh.filesGen
+		}
+	}
+	return err
+}
+
+// executeAndOr runs the first pipeline and then each following one whose
+// operator matches the previous result: "&&" after success, "||" after
+// failure. A skipped pipeline leaves the previous result in place.
+func (sh *shell) executeAndOr(andOr *AndOr, s streams) error {
+	err := sh.executePipeline(andOr.Pipelines[0], s)
+	for i, op := range andOr.Ops {
+		if unwinds(err) {
+			return err
+		}
+		if (op == "&&") != (err == nil) {
+			continue
+		}
+		err = sh.executePipeline(andOr.Pipelines[i+1], s)
+	}
+	return err
+}
+
+// executePipeline runs a pipeline and records its status for $?.
+func (sh *shell) executePipeline(pipeline *Pipeline, s streams) error {
+	var err error
+	if len(pipeline.Cmds) == 1 {
+		err = sh.executeCommand(pipeline.Cmds[0], s)
+	} else {
+		err = sh.executeMultiPipeline(pipeline, s)
+	}
+	sh.lastStatus = statusOf(err)
+	return err
+}
+
+func (sh *shell) executeCommand(cmd Command, s streams) error {
+	switch cmd := cmd.(type) {
+	case *SimpleCommand:
+		return sh.executeSimpleCommand(cmd, s)
+	case *Subshell:
+		// A subshell runs in a copy of the shell, so exit only ends the
+		// subshell.
+		c := sh.clone()
+		err := c.executeCompound(cmd, cmd.Redirs, s)
+		releaseFiles(c.execFiles, nil)
+		return subshellResult(err)
+	case *FuncDef:
+		sh.funcs[cmd.Name] = cmd
+		return nil
+	}
+	return sh.executeCompound(cmd, *commandRedirs(cmd), s)
+}
+
+// executeCompound runs a compound command in the current shell with its
+// redirections applied around all of it.
+func (sh *shell) executeCompound(cmd Command, redirs []*ReDirection, s streams) error {
+	sh.io = s
+	s, release, err := sh.applyRedirections(redirs, s)
+	if err != nil {
+		fmt.Fprintf(s.stderr, "redirection error: %v\n", err)
+		return err
+	}
+	defer release()
+
+	switch cmd := cmd.(type) {
+	case *ArithCommand:
+		return sh.executeArithCommand(cmd, s)
+	case *Subshell:
+		return sh.executeList(cmd.List, s)
+	case *BraceGroup:
+		return sh.executeList(cmd.List, s)
+	case *IfClause:
+		return sh.executeIf(cmd, s)
+	case *WhileClause:
+		return sh.executeWhile(cmd, s)
+	case *ForClause:
+		return sh.executeFor(cmd, s)
+	case *ArithForClause:
+		return sh.executeArithFor(cmd, s)
+	case *CaseClause:
+		return sh.executeCase(cmd, s)
+	}
+	return fmt.Errorf("unknown command type %T", cmd)
+}
+
+// subshellResult turns control flow that cannot leave a copy of the shell,
+// such as exit or break, into the copy's plain result.
+func subshellResult(err error) error {
+	switch err := err.(type) {
+	case shellExit:
+		if err == 0 {
+			return nil
+		}
+		return exitStatus(err)
+	case funcReturn:
+		return subshellResult(shellExit(err))
+	case loopControl:
+		return nil
+	}
+	return err
+}
+
+// executeArithCommand runs ((expr)), which fails when expr evaluates to 0.
+func (sh *shell) executeArithCommand(cmd *ArithCommand, s streams) error {
+	sh.io = s
+	n, err := sh.evalArithWord(cmd.Expr)
+	if err != nil {
+		fmt.Fprintln(s.stderr, err)
+		return exitStatus(1)
+	}
+	if n == 0 {
+		return exitStatus(1)
+	}
+	return nil
+}
+
+func (sh *shell) executeSimpleCommand(cmd *SimpleCommand, s streams) error {
+	sh.io = s
+	sh.substStatus = 0
+	defer sh.beginProcSubsts()()
+	args, err := sh.expandWords(cmd.Args)
+	if err != nil {
+		fmt.Fprintln(s.stderr, err)
+		return exitStatus(1)
+	}
+
+	if len(args) == 1 && args[0] == "exec" {
+		return sh.execRedirections(cmd.Redirs, s)
+	}
+	s, release, err := sh.applyRedirections(cmd.Redirs, s)
+	if err != nil {
+		fmt.Fprintf(s.stderr, "redirection error: %v\n", err)
+		return err
+	}
+	defer release()
+
+	var env []string
+	for _, assign := range cmd.Assigns {
+		value, err := sh.expandAssign(assign.Value)
+		if err != nil {
+			fmt.Fprintln(s.stderr, err)
+			return exitStatus(1)
+		}
+		if len(args) == 0 {
+			sh.setVar(assign.Name, value)
+		} else {
+			env = append(env, assign.Name+"="+value)
+		}
+	}
+
+	s = sh.procSubstStreams(s)
+
+	if len(args) == 0 {
+		if sh.substStatus != 0 {
+			return exitStatus(sh.substStatus)
+		}
+		return nil
+	}
+	if args[0] == "exec" {
+		// exec runs the command in place of the shell, which then exits
+		// with the command's status.
+		return shellExit(statusOf(sh.runCommand(args[1:], env, s)))
+	}
+	return sh.runCommand(args, env, s)
+}
+
+// execRedirections runs exec without a command, which applies its
+// redirections to the shell's own descriptors so that they stay open. The
+// redirections of an enclosing command are not part of those. A file that
+// no descriptor refers to any more is closed.
+func (sh *shell) execRedirections(redirs []*ReDirection, s streams) error {
+	files, opened, err := sh.redirect(redirs, sh.files)
+	if err != nil {
+		fmt.Fprintf(s.stderr, "redirection error: %v\n", err)
+		return err
+	}
+	if sh.execFiles == nil {
+		sh.execFiles = make(map[*os.File]*ownedFile)
+	}
+	for f, o := range opened {
+		sh.execFiles[f] = o
+	}
+	sh.files = files
+	sh.filesGen++
+	sh.releaseExecFiles()
+	return nil
+}
+
+// releaseExecFiles closes the files exec opened that the shell's
+// descriptors no longer refer to.
+func (sh *shell) releaseExecFiles() {
+	live := map[*os.File]bool{
+		sh.files.stdin:  true,
+		sh.files.stdout: true,
+		sh.files.stderr: true,
+	}
+	for _, f := range sh.files.extra {
+		live[f] = true
+	}
+	releaseFiles(sh.execFiles, live)
+}
+
+// runCommand runs a function, builtin or external command with its expanded
+// arguments. env holds the assignments that prefixed the command.
+func (sh *shell) runCommand(args []string, env []string, s streams) error {
+	commandName := args[0]
+	if fn, ok := sh.funcs[commandName]; ok {
+		return sh.callFunction(fn, args[1:], env, s)
+	}
+	if isBuiltinCommand(commandName) {
+		return sh.executeBuiltinCommand(commandName, args[1:], s)
+	}
+
+	if err := sh.checkCommand(commandName); err != nil {
+		fmt.Fprintln(s.stderr, err)
+		return err
+	}
+
+	c := exec.Command(commandName, args[1:]...)
+	c.Env = sh.environ(env)
+	c.Dir = sh.dir
+	// A closed standard descriptor is given to the child as /dev/null.
+	if s.stdin != nil {
+		c.Stdin = s.stdin
+	}
+	if s.stdout != nil {
+		c.Stdout = s.stdout
+	}
+	if s.stderr != nil {
+		c.Stderr = s.stderr
+	}
+	c.ExtraFiles = s.extraFiles()
+	err := c.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		// The command passed checkCommand but could not be started, as
+		// with a binary for another architecture.
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		err = &commandError{commandName + ": " + err.Error(), 126}
+		fmt.Fprintln(s.stderr, err)
+	}
+	return err
+}
+
+// commandError reports a command that could not be started, carrying the
+// conventional status: 127 when it was not found, 126 when it was found but
+// cannot be executed.
+type commandError struct {
+	msg    string
+	status int
+}
+
+func (e *commandError) Error() string {
+	return e.msg
+}
+
+func (e *commandError) Unwrap() error {
+	return exitStatus(e.status)
+}
+
+func (sh *shell) checkCommand(commandName string) error {
+	if !strings.Contains(commandName, "/") {
+		if findExecPath(commandName) == "" {
+			return &commandError{commandName + ": command not found", 127}
+		}
+		return nil
+	}
+
+	info, err := os.Stat(sh.abs(commandName))
+	switch {
+	case err != nil:
+		return &commandError{commandName + ": No such file or directory", 127}
+	case info.IsDir():
+		return &commandError{commandName + ": Is a directory", 126}
+	case !isExecutable(info.Mode()):
+		return &commandError{commandName + ": Permission denied", 126}
+	}
+	return nil
+}
+
+// executeMultiPipeline runs every stage concurrently, each with its own end
+// of the connecting pipes and its own copy of the shell state. A stage
+// closes its pipe ends when it finishes so that neighbours see EOF or
+// EPIPE. The pipeline's result is the last stage's.
+func (sh *shell) executeMultiPipeline(pipeline *Pipeline, s streams) error {
+	n := len(pipeline.Cmds)
+
+	pipes := make([][2]*os.File, n-1)
+	for i := 0; i < n-1; i++ {
+		pipeReader, pipeWriter, err := os.Pipe()
+		if err != nil {
+			cleanupPipes(pipes[:i])
+			return fmt.Errorf("failed to create pipe: %v", err)
+		}
+		pipes[i][0] = pipeReader
+		pipes[i][1] = pipeWriter
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+
+	for i, cmd := range pipeline.Cmds {
+		stage := s
+		if i > 0 {
+			stage.stdin = pipes[i-1][0]
+		}
+		if i < n-1 {
+			stage.stdout = pipes[i][1]
+		}
+
+		wg.Add(1)
+		go func(i int, cmd Command, stage streams) {
+			defer wg.Done()
+			c := sh.clone()
+			errs[i] = subshellResult(c.executeCommand(cmd, stage))
+			releaseFiles(c.execFiles, nil)
+			if i > 0 {
+				pipes[i-1][0].Close()
+			}
+			if i < n-1 {
+				pipes[i][1].Close()
+			}
+		}(i, cmd, stage)
+	}
+
+	wg.Wait()
+	return errs[n-1]
+}
+
+func cleanupPipes(pipes [][2]*os.File) {
+	for _, pipe := range pipes {
+		if pipe[0] != nil {
+			pipe[0].Close()
+		}
+		if pipe[1] != nil {
+			pipe[1].Close()
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnstartableCommandStatus(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "badbin")
+	if err := os.WriteFile(bin, []byte("\x7fELF garbage"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := run(t, bin+" 2>/dev/null; echo $?"), "126\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestArithCommandRedirections(t *testing.T) {
+	got := run(t, `x=1; ((x++)) 2>/dev/null; ((1/0)) 2>/dev/null; echo "$x $?"`)
+	if want := "2 1\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,783 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// fieldPart is a piece of an expanded word. Quoted pieces are kept intact;
+// split pieces came from unquoted expansions and are subject to field
+// splitting.
+type fieldPart struct {
+	val    string
+	quoted bool
+	split  bool
+	// sep separates positional parameters from $@, which end up in
+	// separate fields.
+	sep bool
+}
+
+// expandWords turns command words into the argument strings passed to
+// builtins and external commands: brace expansion, then parameter and
+// command expansions, field splitting and pathname expansion. What happens
+// to a pattern that matches nothing depends on the nullglob and failglob
+// options.
+func (sh *shell) expandWords(words []*Word) ([]string, error) {
+	var braced []*Word
+	for _, w := range words {
+		braced = append(braced, braceExpand(w)...)
+	}
+
+	args := make([]string, 0, len(braced))
+	for _, w := range braced {
+		parts, err := sh.expandParts(sh.expandTilde(w.Parts, false), false)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range sh.splitFields(parts) {
+			chars, quals := splitQualifiers(patternChars(field), sh.options["extglob"])
+			if quals == nil && !hasMeta(chars) {
+				args = append(args, joinParts(field))
+				continue
+			}
+
+			var matches []string
+			if hasMeta(chars) {
+				matches = sh.expandGlob(chars)
+			} else if _, err := os.Lstat(sh.abs(charsText(chars))); err == nil {
+				matches = []string{charsText(chars)}
+			}
+			if quals != nil {
+				matches = quals.apply(sh, matches)
+			}
+
+			switch {
+			case len(matches) > 0:
+				args = append(args, matches...)
+			case sh.options["failglob"]:
+				return nil, fmt.Errorf("no match: %s", joinParts(field))
+			case !sh.options["nullglob"] && (quals == nil || !quals.nullglob):
+				args = append(args, joinParts(field))
+			}
+		}
+	}
+	return args, nil
+}
+
+// expandWord expands a word that must produce exactly one string, such as a
+// redirection target. No field splitting is done.
+func (sh *shell) expandWord(w *Word) (string, error) {
+	parts, err := sh.expandParts(sh.expandTilde(w.Parts, false), false)
+	if err != nil {
+		return "", err
+	}
+	return joinParts(parts), nil
+}
+
+// expandAssign expands the value of a NAME=value assignment, where a tilde
+// is also expanded after each ':'.
+func (sh *shell) expandAssign(w *Word) (string, error) {
+	parts, err := sh.expandParts(sh.expandTilde(w.Parts, true), false)
+	if err != nil {
+		return "", err
+	}
+	return joinParts(parts), nil
+}
+
+// expandTilde replaces unquoted tilde-prefixes with the directories they
+// name: ~ and ~/path use $HOME, ~user the user's home directory, ~+ $PWD
+// and ~- $OLDPWD. A prefix must start the word, or in an assignment follow
+// a ':', and it ends at the first '/' (or ':' in an assignment). Prefixes
+// that name nothing are left alone.
+func (sh *shell) expandTilde(parts []WordPart, assign bool) []WordPart {
+	var out []WordPart
+	for pi, part := range parts {
+		lit, ok := part.(*Lit)
+		if !ok || !strings.Contains(lit.Value, "~") || (pi > 0 && !assign) {
+			out = append(out, part)
+			continue
+		}
+
+		var b partsBuilder
+		text := lit.Value
+		for i := 0; i < len(text); i++ {
+			atStart := i == 0 && pi == 0
+			afterColon := assign && i > 0 && text[i-1] == ':'
+			if text[i] != '~' || !(atStart || afterColon) {
+				b.lit.WriteByte(text[i])
+				continue
+			}
+
+			end := len(text)
+			for j := i + 1; j < len(text); j++ {
+				if text[j] == '/' || (assign && text[j] == ':') {
+					end = j
+					break
+				}
+			}
+			// A prefix running into a quoted or expanded part is not one.
+			if end == len(text) && pi < len(parts)-1 {
+				b.lit.WriteByte(text[i])
+				continue
+			}
+
+			dir, ok := sh.tildeDir(text[i+1 : end])
+			if !ok {
+				b.lit.WriteByte(text[i])
+				continue
+			}
+			b.add(&SglQuoted{Value: dir})
+			i = end - 1
+		}
+		out = append(out, b.done()...)
+	}
+	return out
+}
+
+func (sh *shell) tildeDir(prefix string) (string, bool) {
+	switch prefix {
+	case "":
+		if home, ok := sh.lookupVar("HOME"); ok {
+			return home, true
+		}
+		if u, err := user.Current(); err == nil {
+			return u.HomeDir, true
+		}
+		return "", false
+	case "+":
+		if pwd, ok := sh.lookupVar("PWD"); ok {
+			return pwd, true
+		}
+		return sh.dir, true
+	case "-":
+		return sh.lookupVar("OLDPWD")
+	}
+
+	if u, err := user.Lookup(prefix); err == nil {
+		return u.HomeDir, true
+	}
+	return "", false
+}
+
+func joinParts(parts []fieldPart) string {
+	var sb strings.Builder
+	for _, p := range parts {
+		sb.WriteString(p.val)
+	}
+	return sb.String()
+}
+
+func (sh *shell) expandParts(parts []WordPart, quoted bool) ([]fieldPart, error) {
+	var out []fieldPart
+	for _, part := range parts {
+		switch p := part.(type) {
+		case *Lit:
+			out = append(out, fieldPart{val: p.Value, quoted: quoted})
+
+		case *SglQuoted:
+			out = append(out, fieldPart{val: p.Value, quoted: true})
+
+		case *DblQuoted:
+			if len(sh.params) == 0 && len(p.Parts) == 1 && isAllParams(p.Parts[0]) {
+				// "$@" without positional parameters is no argument
+				// at all.
+				continue
+			}
+			inner, err := sh.expandParts(p.Parts, true)
+			if err != nil {
+				return nil, err
+			}
+			// "" still produces an (empty) argument.
+			out = append(out, fieldPart{quoted: true})
+			out = append(out, inner...)
+
+		case *ParamExp:
+			expanded, err := sh.expandParam(p, quoted)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, expanded...)
+
+		case *CmdSubst:
+			output, err := sh.commandSubstitution(p.List)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, fieldPart{val: output, quoted: quoted, split: !quoted})
+
+		case *ProcSubst:
+			path, err := sh.processSubstitution(p)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, fieldPart{val: path, quoted: quoted})
+
+		case *ArithExp:
+			n, err := sh.evalArithWord(p.Expr)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, fieldPart{val: strconv.FormatInt(n, 10), quoted: quoted, split: !quoted})
+		}
+	}
+	return out, nil
+}
+
+// commandSubstitution runs list in a copy of the shell and returns its
+// standard output without trailing newlines.
+func (sh *shell) commandSubstitution(list *List) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+
+	var output strings.Builder
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&output, r)
+		r.Close()
+		close(done)
+	}()
+
+	s := sh.io
+	s.stdout = w
+	err = sh.clone().executeList(list, s)
+	w.Close()
+	<-done
+
+	sh.substStatus = statusOf(err)
+	sh.lastStatus = sh.substStatus
+	return strings.TrimRight(output.String(), "\n"), nil
+}
+
+// procSubst is a running process substitution. file is the shell's end of
+// its pipe, which the command is given under the /dev/fd path that the
+// substitution expanded to.
+type procSubst struct {
+	file *os.File
+	done chan struct{}
+}
+
+// processSubstitution starts the list of <(...) or >(...) in a copy of the
+// shell, connected to a pipe, and returns the /dev/fd path of the other
+// end. The command being expanded receives that end at the same descriptor
+// number, see finishProcSubsts.
+func (sh *shell) processSubstitution(ps *ProcSubst) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+
+	s := sh.io
+	file, inner := r, w
+	if ps.Out {
+		s.stdin = r
+		file, inner = w, r
+	} else {
+		s.stdout = w
+	}
+
+	proc := &procSubst{file: file, done: make(chan struct{})}
+	go func(c *shell) {
+		c.executeList(ps.List, s)
+		inner.Close()
+		close(proc.done)
+	}(sh.clone())
+
+	sh.procSubsts = append(sh.procSubsts, proc)
+	return fmt.Sprintf("/dev/fd/%d", file.Fd()), nil
+}
+
+// beginProcSubsts starts collecting the process substitutions of one
+// command. The returned function ends it, closing them and waiting for
+// their commands.
+func (sh *shell) beginProcSubsts() func() {
+	outer := sh.procSubsts
+	sh.procSubsts = nil
+	return func() {
+		finishProcSubsts(sh.procSubsts)
+		sh.procSubsts = outer
+	}
+}
+
+// procSubstStreams returns s with the process substitutions collected so
+// far open as the descriptors their /dev/fd paths name.
+func (sh *shell) procSubstStreams(s streams) streams {
+	for _, proc := range sh.procSubsts {
+		s = s.withFd(int(proc.file.Fd()), proc.file)
+	}
+	return s
+}
+
+// finishProcSubsts closes the shell's ends of the process substitutions
+// and waits for them, so that a >(...) reader has seen all of its input
+// before the next command runs.
+func finishProcSubsts(procs []*procSubst) {
+	for _, proc := range procs {
+		proc.file.Close()
+		<-proc.done
+	}
+}
+
+func (sh *shell) paramValue(name string) (string, bool) {
+	switch name {
+	case "?":
+		return strconv.Itoa(sh.lastStatus), true
+	case "$":
+		return strconv.Itoa(os.Getpid()), true
+	case "0":
+		return os.Args[0], true
+	case "#":
+		return strconv.Itoa(len(sh.params)), true
+	case "@":
+		return strings.Join(sh.params, " "), len(sh.params) > 0
+	case "*":
+		sep := ""
+		for _, r := range sh.ifs() {
+			sep = string(r)
+			break
+		}
+		return strings.Join(sh.params, sep), len(sh.params) > 0
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		switch {
+		case n == 0:
+			// ${00} is $0 with leading zeros.
+			return os.Args[0], true
+		case n > len(sh.params):
+			return "", false
+		}
+		return sh.params[n-1], true
+	}
+	return sh.lookupVar(name)
+}
+
+// expandParamWord expands the word of ${NAME-word} or ${NAME+word}. When
+// the expansion is unquoted, so is the word's own text, which is split
+// into fields like the value of a parameter.
+func (sh *shell) expandParamWord(w *Word, quoted bool) ([]fieldPart, error) {
+	parts, err := sh.expandParts(w.Parts, quoted)
+	if err != nil || quoted {
+		return parts, err
+	}
+	for i := range parts {
+		if !parts[i].quoted {
+			parts[i].split = true
+		}
+	}
+	return parts, nil
+}
+
+// isAllParams reports whether part is a plain $@.
+func isAllParams(part WordPart) bool {
+	pe, ok := part.(*ParamExp)
+	return ok && pe.Name == "@" && pe.Op == "" && !pe.Length
+}
+
+// expandPositional expands $@ and $*. "$@" gives every positional
+// parameter as a field of its own and "$*" joins them into one; unquoted,
+// each parameter is split on its own.
+func (sh *shell) expandPositional(name string, quoted bool) []fieldPart {
+	if quoted && name == "*" {
+		value, _ := sh.paramValue(name)
+		return []fieldPart{{val: value, quoted: true}}
+	}
+	var out []fieldPart
+	for i, param := range sh.params {
+		if i > 0 {
+			out = append(out, fieldPart{val: " ", quoted: true, sep: true})
+		}
+		out = append(out, fieldPart{val: param, quoted: quoted, split: !quoted})
+	}
+	return out
+}
+
+func (sh *shell) expandParam(pe *ParamExp, quoted bool) ([]fieldPart, error) {
+	allParams := pe.Name == "@" || pe.Name == "*"
+	if allParams && pe.Op == "" && !pe.Length {
+		return sh.expandPositional(pe.Name, quoted), nil
+	}
+	value, set := sh.paramValue(pe.Name)
+	result := func(val string) []fieldPart {
+		return []fieldPart{{val: val, quoted: quoted, split: !quoted}}
+	}
+
+	// Without a colon the operators only test whether the parameter is set;
+	// with one an empty value counts as unset too.
+	useArg := !set
+	if strings.HasPrefix(pe.Op, ":") {
+		useArg = !set || value == ""
+	}
+
+	switch strings.TrimPrefix(pe.Op, ":") {
+	case "-":
+		if useArg {
+			return sh.expandParamWord(pe.Arg, quoted)
+		}
+	case "=":
+		if useArg {
+			if !isValidName(pe.Name) {
+				return nil, fmt.Errorf("$%s: cannot assign in this way", pe.Name)
+			}
+			val, err := sh.expandWord(pe.Arg)
+			if err != nil {
+				return nil, err
+			}
+			sh.setVar(pe.Name, val)
+			return result(val), nil
+		}
+	case "+":
+		if useArg {
+			return nil, nil
+		}
+		return sh.expandParamWord(pe.Arg, quoted)
+	case "?":
+		if useArg {
+			msg, err := sh.expandWord(pe.Arg)
+			if err != nil {
+				return nil, err
+			}
+			if msg == "" {
+				msg = "parameter null or not set"
+			}
+			return nil, fmt.Errorf("%s: %s", pe.Name, msg)
+		}
+	}
+
+	if pe.Length && allParams {
+		return result(strconv.Itoa(len(sh.params))), nil
+	}
+	if pe.Length {
+		return result(strconv.Itoa(utf8.RuneCountInString(value))), nil
+	}
+
+	var err error
+	switch pe.Op {
+	case "#", "##", "%", "%%":
+		var pat *pattern
+		if pat, err = sh.expandPattern(pe.Arg); err == nil {
+			value = trimPattern(value, pat, pe.Op)
+		}
+	case "/", "//", "/#", "/%":
+		value, err = sh.replacePattern(value, pe)
+	case ":":
+		value, err = sh.substring(value, pe)
+	case "^^", "^", ",,", ",":
+		value, err = sh.convertCase(value, pe)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result(value), nil
+}
+
+// expandPattern expands a pattern word. Unquoted characters, including those
+// from unquoted expansions, keep their pattern meaning.
+func (sh *shell) expandPattern(w *Word) (*pattern, error) {
+	parts, err := sh.expandParts(w.Parts, false)
+	if err != nil {
+		return nil, err
+	}
+	return compilePattern(patternChars(parts), patOptions{extglob: sh.options["extglob"]}), nil
+}
+
+// runeOffsets returns the byte offset of every character boundary in s,
+// including len(s).
+func runeOffsets(s string) []int {
+	offsets := make([]int, 0, len(s)+1)
+	for i := range s {
+		offsets = append(offsets, i)
+	}
+	return append(offsets, len(s))
+}
+
+// trimPattern removes the shortest ("#", "%") or longest ("##", "%%")
+// prefix or suffix of value matching pat.
+func trimPattern(value string, pat *pattern, op string) string {
+	offsets := runeOffsets(value)
+	n := len(offsets)
+	for k := 0; k < n; k++ {
+		switch op {
+		case "#":
+			if i := offsets[k]; pat.match(value[:i]) {
+				return value[i:]
+			}
+		case "##":
+			if i := offsets[n-1-k]; pat.match(value[:i]) {
+				return value[i:]
+			}
+		case "%":
+			if i := offsets[n-1-k]; pat.match(value[i:]) {
+				return value[:i]
+			}
+		case "%%":
+			if i := offsets[k]; pat.match(value[i:]) {
+				return value[:i]
+			}
+		}
+	}
+	return value
+}
+
+// replacePattern implements ${NAME/pattern/string} and its variants: "//"
+// replaces every match, "/#" and "/%" only a match at the start or end.
+// Each match is the longest one at the leftmost position.
+func (sh *shell) replacePattern(value string, pe *ParamExp) (string, error) {
+	pat, err := sh.expandPattern(pe.Arg)
+	if err != nil {
+		return "", err
+	}
+	repl := ""
+	if pe.Arg2 != nil {
+		if repl, err = sh.expandWord(pe.Arg2); err != nil {
+			return "", err
+		}
+	}
+	anchored := pe.Op == "/#" || pe.Op == "/%"
+
+	offsets := runeOffsets(value)
+	var sb strings.Builder
+	last := 0
+	for si := 0; si < len(offsets); si++ {
+		start := offsets[si]
+		if pe.Op == "/#" && start > 0 {
+			break
+		}
+
+		end := -1
+		for ei := len(offsets) - 1; ei >= si; ei-- {
+			if pe.Op == "/%" && ei != len(offsets)-1 {
+				break
+			}
+			if pat.match(value[start:offsets[ei]]) {
+				end = ei
+				break
+			}
+		}
+		// Empty matches are ignored, except at an anchor, so that
+		// ${v/#/P} prepends P.
+		if end < si || (end == si && !anchored) {
+			continue
+		}
+
+		sb.WriteString(value[last:start])
+		sb.WriteString(repl)
+		last = offsets[end]
+		if pe.Op != "//" {
+			break
+		}
+		si = end - 1
+	}
+	sb.WriteString(value[last:])
+	return sb.String(), nil
+}
+
+// substring implements ${NAME:offset:length}. Offsets count characters; a
+// negative offset counts from the end and a negative length gives the end
+// position counted from the end.
+func (sh *shell) substring(value string, pe *ParamExp) (string, error) {
+	runes := []rune(value)
+	offset, err := sh.evalInt(pe.Arg)
+	if err != nil {
+		return "", err
+	}
+	if offset < 0 {
+		offset += len(runes)
+	}
+	if offset < 0 || offset > len(runes) {
+		return "", nil
+	}
+
+	end := len(runes)
+	if pe.Arg2 != nil {
+		length, err := sh.evalInt(pe.Arg2)
+		if err != nil {
+			return "", err
+		}
+		if length < 0 {
+			end += length
+			if end < offset {
+				return "", fmt.Errorf("%s: substring expression < 0", wordText(pe.Arg2))
+			}
+		} else if length < end-offset {
+			end = offset + length
+		}
+	}
+	return string(runes[offset:end]), nil
+}
+
+// evalInt expands a word and evaluates it as an arithmetic expression.
+func (sh *shell) evalInt(w *Word) (int, error) {
+	n, err := sh.evalArithWord(w)
+	return int(n), err
+}
+
+// evalArithWord expands a word and evaluates it as an arithmetic
+// expression.
+func (sh *shell) evalArithWord(w *Word) (int64, error) {
+	text, err := sh.expandWord(w)
+	if err != nil {
+		return 0, err
+	}
+	return sh.evalArith(text)
+}
+
+// convertCase implements ${NAME^^}, ${NAME^}, ${NAME,,} and ${NAME,}. An
+// optional pattern restricts which characters are converted.
+func (sh *shell) convertCase(value string, pe *ParamExp) (string, error) {
+	var pat *pattern
+	if len(pe.Arg.Parts) > 0 {
+		var err error
+		if pat, err = sh.expandPattern(pe.Arg); err != nil {
+			return "", err
+		}
+	}
+
+	convert := unicode.ToUpper
+	if strings.HasPrefix(pe.Op, ",") {
+		convert = unicode.ToLower
+	}
+
+	runes := []rune(value)
+	for i, r := range runes {
+		if i > 0 && len(pe.Op) == 1 {
+			break
+		}
+		if pat == nil || pat.match(string(r)) {
+			runes[i] = convert(r)
+		}
+	}
+	return string(runes), nil
+}
+
+func (sh *shell) ifs() string {
+	if ifs, ok := sh.lookupVar("IFS"); ok {
+		return ifs
+	}
+	return " \t\n"
+}
+
+// splitFields joins the parts of one word into fields, splitting the
+// unquoted expansion results on $IFS. A word made only of empty unquoted
+// expansions produces no field at all. Fields keep their parts so that
+// pathname expansion can tell quoted characters apart.
+func (sh *shell) splitFields(parts []fieldPart) [][]fieldPart {
+	ifs := sh.ifs()
+	var fields [][]fieldPart
+	var cur []fieldPart
+	inField := false
+	afterSpace := false
+
+	endField := func() {
+		fields = append(fields, cur)
+		cur = nil
+		inField = false
+	}
+
+	for _, p := range parts {
+		if p.sep {
+			if inField {
+				endField()
+			}
+			afterSpace = false
+			continue
+		}
+		if !p.split {
+			cur = append(cur, p)
+			if p.quoted || p.val != "" {
+				inField = true
+			}
+			continue
+		}
+
+		start := 0
+		for i, r := range p.val {
+			if !strings.ContainsRune(ifs, r) {
+				inField = true
+				afterSpace = false
+				continue
+			}
+			if i > start {
+				cur = append(cur, fieldPart{val: p.val[start:i]})
+			}
+			start = i + utf8.RuneLen(r)
+
+			if r == ' ' || r == '\t' || r == '\n' {
+				if inField {
+					endField()
+					afterSpace = true
+				}
+				continue
+			}
+
+			// A non-whitespace separator always ends a field, unless the
+			// field was just ended by whitespace around it.
+			if inField || !afterSpace {
+				endField()
+			}
+			afterSpace = false
+		}
+		if start < len(p.val) {
+			cur = append(cur, fieldPart{val: p.val[start:]})
+		}
+	}
+
+	if inField {
+		endField()
+	}
+	return fields
+}
+
+// wordText returns the word with quotes removed, without any expansion.
+func wordText(w *Word) string {
+	var sb strings.Builder
+	writePartsText(&sb, w.Parts)
+	return sb.String()
+}
+
+func writePartsText(sb *strings.Builder, parts []WordPart) {
+	for _, part := range parts {
+		switch p := part.(type) {
+		case *Lit:
+			sb.WriteString(p.Value)
+		case *SglQuoted:
+			sb.WriteString(p.Value)
+		case *DblQuoted:
+			writePartsText(sb, p.Parts)
+		case *ParamExp:
+			if p.Op == "" && !p.Length {
+				sb.WriteString("$" + p.Name)
+				continue
+			}
+			sb.WriteString("${")
+			if p.Length {
+				sb.WriteString("#")
+			}
+			sb.WriteString(p.Name + p.Op)
+			if p.Arg != nil {
+				sb.WriteString(wordText(p.Arg))
+			}
+			if p.Arg2 != nil {
+				sb.WriteString(p.Op[:1] + wordText(p.Arg2))
+			}
+			sb.WriteString("}")
+		case *CmdSubst:
+			sb.WriteString("$(...)")
+		case *ProcSubst:
+			if p.Out {
+				sb.WriteString(">(...)")
+			} else {
+				sb.WriteString("<(...)")
+			}
+		case *ArithExp:
+			sb.WriteString("$((" + wordText(p.Expr) + "))")
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// run parses and executes src in a new shell and returns what it wrote to
+// standard output.
+func run(t *testing.T, src string) string {
+	t.Helper()
+	list, err := parse(src, true)
+	if err != nil {
+		t.Fatalf("parse %q: %v", src, err)
+	}
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	s := stdStreams()
+	s.stdout = out
+	newShell().executeList(list, s)
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPositionalParams(t *testing.T) {
+	zero := strconv.Itoa(len(os.Args[0]))
+	tests := []struct {
+		src, want string
+	}{
+		{`set -- a "b c"; echo "$# [$1] [$2] [$3]"`, "2 [a] [b c] []\n"},
+		{`set -- a b c d e f g h i j; echo ${10} $10`, "j a0\n"},
+		{`set -- a; echo "${00}" | grep -c .`, "1\n"},
+		{`set -- a; echo ${#00}`, zero + "\n"},
+		{`set -- a b; shift; echo "$# $1"`, "1 b\n"},
+		{`f() { for a; do echo "[$a]"; done; }; f "x y" ""`, "[x y]\n[]\n"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestProcSubstInCompoundWords(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`for f in <(echo x) <(echo y); do cat $f; done`, "x\ny\n"},
+		{`case <(echo z) in /dev/fd/*) echo matched;; esac`, "matched\n"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParamOperatorWord(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`echo "${x:-"q u"}"`, "q u\n"},
+		{`for a in ${v:-a   b}; do echo "[$a]"; done`, "[a]\n[b]\n"},
+		{`for a in ${v:-"a   b"}; do echo "[$a]"; done`, "[a   b]\n"},
+		{`v=1; for a in ${v:+x  y} "${v:+x  y}"; do echo "[$a]"; done`, "[x]\n[y]\n[x  y]\n"},
+	}
+	for _, tt := range tests {
+		if got := run(t, tt.src); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestReplaceEmptyPattern(t *testing.T) {
+	got := run(t, `v=abc; echo ${v/#/P} ${v/%/S} ${v//} ${v/} ${v/#a*/Q}`)
+	if want := "Pabc abcS abc abc Q\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
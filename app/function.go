@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxFuncDepth bounds the nesting of function calls, so that runaway
+// recursion fails instead of exhausting the stack.
+const maxFuncDepth = 1000
+
+// callFunction runs a function with args as its positional parameters. env
+// holds the assignments that prefixed the call, which last for the call
+// and are exported to the commands it runs.
+func (sh *shell) callFunction(fn *FuncDef, args, env []string, s streams) error {
+	if len(sh.scopes) >= maxFuncDepth {
+		fmt.Fprintf(s.stderr, "%s: maximum function nesting level exceeded (%d)\n", fn.Name, maxFuncDepth)
+		return exitStatus(1)
+	}
+	params := sh.params
+	sh.params = args
+	sh.scopes = append(sh.scopes, make(map[string]*variable))
+	defer func() {
+		sh.popScope()
+		sh.params = params
+	}()
+
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		sh.makeLocal(name)
+		sh.setVar(name, value)
+		sh.exportVar(name)
+	}
+
+	err := sh.executeCommand(fn.Body, s)
+	if ret, ok := err.(funcReturn); ok {
+		if ret == 0 {
+			return nil
+		}
+		return exitStatus(ret)
+	}
+	return err
+}
+
+// makeLocal makes name local to the innermost function call, remembering
+// the variable it shadows. The new variable is unset, but stays exported
+// if the shadowed one was. A name that is already local is left alone.
+func (sh *shell) makeLocal(name string) {
+	scope := sh.scopes[len(sh.scopes)-1]
+	if _, ok := scope[name]; ok {
+		return
+	}
+	old := sh.vars[name]
+	scope[name] = old
+	if old == nil {
+		return
+	}
+	if old.exported {
+		sh.vars[name] = &variable{exported: true}
+	} else {
+		delete(sh.vars, name)
+	}
+	sh.syncEnv(name)
+}
+
+// popScope ends the innermost function call, putting back the variables
+// its locals shadowed.
+func (sh *shell) popScope() {
+	scope := sh.scopes[len(sh.scopes)-1]
+	sh.scopes = sh.scopes[:len(sh.scopes)-1]
+	for name, old := range scope {
+		cur := sh.vars[name]
+		if old == nil {
+			delete(sh.vars, name)
+		} else {
+			sh.vars[name] = old
+		}
+		if (cur != nil && cur.exported) || (old != nil && old.exported) {
+			sh.syncEnv(name)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// splitPath splits pattern characters into '/'-separated components. A
+// leading '/' yields an empty first component.
+func splitPath(chars []patChar) [][]patChar {
+	var components [][]patChar
+	start := 0
+	for i, c := range chars {
+		if c.r == '/' {
+			components = append(components, chars[start:i])
+			start = i + 1
+		}
+	}
+	return append(components, chars[start:])
+}
+
+func charsText(chars []patChar) string {
+	var sb strings.Builder
+	for _, c := range chars {
+		sb.WriteRune(c.r)
+	}
+	return sb.String()
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	if strings.HasSuffix(dir, "/") {
+		return dir + name
+	}
+	return dir + "/" + name
+}
+
+func isGlobstar(comp []patChar) bool {
+	return len(comp) == 2 && comp[0] == patChar{r: '*'} && comp[1] == patChar{r: '*'}
+}
+
+// expandGlob performs pathname expansion on a pattern, matching each
+// component against directory entries. The matches are sorted; nil means
+// nothing matched.
+func (sh *shell) expandGlob(chars []patChar) []string {
+	opts := patOptions{extglob: sh.options["extglob"], nocase: sh.options["nocaseglob"]}
+	components := splitPath(chars)
+	matches := []string{""}
+	// mustExist is set when literal components follow the last pattern, as
+	// those paths have not been seen in a directory listing.
+	mustExist := false
+
+	for i, comp := range components {
+		switch {
+		case len(comp) == 0 && i == 0:
+			matches = []string{"/"}
+
+		case len(comp) == 0:
+			// A trailing or doubled slash only keeps directories.
+			var dirs []string
+			for _, m := range matches {
+				if info, err := os.Stat(sh.abs(m)); err == nil && info.IsDir() && !strings.HasSuffix(m, "/") {
+					dirs = append(dirs, m+"/")
+				}
+			}
+			matches = dirs
+
+		case !hasMeta(comp):
+			name := charsText(comp)
+			for j, m := range matches {
+				matches[j] = joinPath(m, name)
+			}
+			mustExist = true
+
+		case isGlobstar(comp) && sh.options["globstar"]:
+			// ** matches any number of directories, or when last, every
+			// file and directory below.
+			last := i == len(components)-1
+			var next []string
+			for _, m := range matches {
+				if !last {
+					next = append(next, m)
+				}
+				next = append(next, sh.globstarPaths(m, !last)...)
+			}
+			matches = next
+			mustExist = false
+
+		default:
+			pat := compilePattern(comp, opts)
+			// A leading '.' must be matched explicitly unless dotglob is set.
+			dotOK := comp[0].r == '.' || sh.options["dotglob"]
+			last := i == len(components)-1
+
+			var next []string
+			for _, m := range matches {
+				dir := m
+				if dir == "" {
+					dir = "."
+				}
+				entries, err := readDirMatching(sh.abs(dir), func(name string) bool {
+					if name == "." || name == ".." || (name[0] == '.' && !dotOK) {
+						return false
+					}
+					return pat.match(name)
+				})
+				if err != nil {
+					continue
+				}
+				for _, entry := range entries {
+					path := joinPath(m, entry.Name())
+					if !last {
+						if info, err := os.Stat(sh.abs(path)); err != nil || !info.IsDir() {
+							continue
+						}
+					}
+					next = append(next, path)
+				}
+			}
+			matches = next
+			mustExist = false
+		}
+
+		if len(matches) == 0 {
+			return nil
+		}
+	}
+
+	if mustExist {
+		existing := matches[:0]
+		for _, m := range matches {
+			if _, err := os.Lstat(sh.abs(m)); err == nil {
+				existing = append(existing, m)
+			}
+		}
+		matches = existing
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// globstarPaths returns every path below dir, or only the directories. It
+// does not descend into symbolic links.
+func (sh *shell) globstarPaths(dir string, dirsOnly bool) []string {
+	var paths []string
+	var walk func(prefix string)
+	walk = func(prefix string) {
+		dir := prefix
+		if dir == "" {
+			dir = "."
+		}
+		entries, err := readDirMatching(sh.abs(dir), func(name string) bool {
+			return name[0] != '.' || sh.options["dotglob"]
+		})
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			path := joinPath(prefix, entry.Name())
+			if entry.IsDir() {
+				paths = append(paths, path)
+				walk(path)
+			} else if !dirsOnly {
+				paths = append(paths, path)
+			}
+		}
+	}
+	walk(dir)
+	return paths
+}
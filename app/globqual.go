@@ -0,0 +1,257 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// globQualifiers are the zsh-style qualifiers of a trailing "(...)" on a
+// glob, e.g. *(.) or *(om[1,5]). Files are tested with os.Lstat.
+type globQualifiers struct {
+	filters  []func(os.FileInfo) bool
+	sortBy   byte
+	reverse  bool
+	hasRange bool
+	first    int
+	last     int
+	nullglob bool
+}
+
+// splitQualifiers separates a trailing qualifier list from the pattern. It
+// returns nil qualifiers when the field does not end in one. With extglob
+// set, a group right after an extglob operator is an extglob group, so
+// !(x) and @(x) are patterns rather than qualifiers.
+func splitQualifiers(chars []patChar, extglob bool) ([]patChar, *globQualifiers) {
+	n := len(chars)
+	if n < 3 || chars[n-1].quoted || chars[n-1].r != ')' {
+		return chars, nil
+	}
+	open := -1
+	for i := n - 2; i >= 0; i-- {
+		if chars[i].r == '(' && !chars[i].quoted {
+			open = i
+			break
+		}
+	}
+	if open <= 0 {
+		return chars, nil
+	}
+	if op := chars[open-1]; extglob && isExtglobOp(op.r) && !op.quoted {
+		return chars, nil
+	}
+	for _, c := range chars[open+1 : n-1] {
+		if c.quoted {
+			return chars, nil
+		}
+	}
+
+	quals, ok := parseQualifiers(charsText(chars[open+1 : n-1]))
+	if !ok {
+		return chars, nil
+	}
+	return chars[:open], quals
+}
+
+func parseQualifiers(q string) (*globQualifiers, bool) {
+	quals := &globQualifiers{}
+	negate := false
+	add := func(test func(os.FileInfo) bool) {
+		if negate {
+			quals.filters = append(quals.filters, func(info os.FileInfo) bool { return !test(info) })
+		} else {
+			quals.filters = append(quals.filters, test)
+		}
+	}
+
+	for i := 0; i < len(q); i++ {
+		switch c := q[i]; c {
+		case '^':
+			negate = !negate
+		case '.':
+			add(func(info os.FileInfo) bool { return info.Mode().IsRegular() })
+		case '/':
+			add(func(info os.FileInfo) bool { return info.IsDir() })
+		case '@':
+			add(func(info os.FileInfo) bool { return info.Mode()&os.ModeSymlink != 0 })
+		case '=':
+			add(func(info os.FileInfo) bool { return info.Mode()&os.ModeSocket != 0 })
+		case 'p':
+			add(func(info os.FileInfo) bool { return info.Mode()&os.ModeNamedPipe != 0 })
+		case '%':
+			add(func(info os.FileInfo) bool { return info.Mode()&os.ModeDevice != 0 })
+		case '*':
+			add(func(info os.FileInfo) bool { return info.Mode().IsRegular() && isExecutable(info.Mode()) })
+		case 'x':
+			add(func(info os.FileInfo) bool { return isExecutable(info.Mode()) })
+		case 'r':
+			add(func(info os.FileInfo) bool { return info.Mode()&0400 != 0 })
+		case 'w':
+			add(func(info os.FileInfo) bool { return info.Mode()&0200 != 0 })
+		case 'N':
+			quals.nullglob = true
+
+		case 'L':
+			test, n, ok := parseSizeQualifier(q[i+1:])
+			if !ok {
+				return nil, false
+			}
+			add(test)
+			i += n
+
+		case 'o', 'O':
+			if i+1 >= len(q) || strings.IndexByte("nLm", q[i+1]) < 0 {
+				return nil, false
+			}
+			quals.sortBy = q[i+1]
+			quals.reverse = c == 'O'
+			i++
+
+		case '[':
+			end := strings.IndexByte(q[i:], ']')
+			if end < 0 {
+				return nil, false
+			}
+			first, last, ok := parseSubscript(q[i+1 : i+end])
+			if !ok {
+				return nil, false
+			}
+			quals.hasRange, quals.first, quals.last = true, first, last
+			i += end
+
+		default:
+			return nil, false
+		}
+	}
+	return quals, true
+}
+
+// parseSizeQualifier reads the rest of an L qualifier: an optional unit
+// (k, m or p for 512-byte blocks), an optional '+' or '-' and a number.
+// Sizes are rounded up to whole units before comparing.
+func parseSizeQualifier(q string) (func(os.FileInfo) bool, int, bool) {
+	i := 0
+	unit := int64(1)
+	if i < len(q) {
+		switch q[i] {
+		case 'k', 'K':
+			unit, i = 1024, i+1
+		case 'm', 'M':
+			unit, i = 1024*1024, i+1
+		case 'p', 'P':
+			unit, i = 512, i+1
+		}
+	}
+	var sign byte
+	if i < len(q) && (q[i] == '+' || q[i] == '-') {
+		sign = q[i]
+		i++
+	}
+	start := i
+	for i < len(q) && isDigit(q[i]) {
+		i++
+	}
+	n, err := strconv.ParseInt(q[start:i], 10, 64)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	test := func(info os.FileInfo) bool {
+		size := (info.Size() + unit - 1) / unit
+		switch sign {
+		case '+':
+			return size > n
+		case '-':
+			return size < n
+		}
+		return size == n
+	}
+	return test, i, true
+}
+
+// parseSubscript reads "n" or "n,m" from a [n,m] qualifier. Indexes are
+// 1-based and negative ones count from the end.
+func parseSubscript(s string) (int, int, bool) {
+	firstText, lastText, hasLast := strings.Cut(s, ",")
+	first, err := strconv.Atoi(strings.TrimSpace(firstText))
+	if err != nil {
+		return 0, 0, false
+	}
+	last := first
+	if hasLast {
+		if last, err = strconv.Atoi(strings.TrimSpace(lastText)); err != nil {
+			return 0, 0, false
+		}
+	}
+	return first, last, true
+}
+
+// apply filters, sorts and slices the sorted matches of a glob.
+func (q *globQualifiers) apply(sh *shell, paths []string) []string {
+	type entry struct {
+		path string
+		info os.FileInfo
+	}
+	var entries []entry
+	for _, path := range paths {
+		info, err := os.Lstat(sh.abs(path))
+		if err != nil {
+			continue
+		}
+		keep := true
+		for _, test := range q.filters {
+			if !test(info) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			entries = append(entries, entry{path, info})
+		}
+	}
+
+	// om sorts newest first and oL smallest first, as in zsh; O reverses.
+	less := func(a, b entry) bool {
+		switch q.sortBy {
+		case 'L':
+			return a.info.Size() < b.info.Size()
+		case 'm':
+			return a.info.ModTime().After(b.info.ModTime())
+		}
+		return a.path < b.path
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if q.reverse {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+
+	if q.hasRange {
+		n := len(entries)
+		first, last := q.first, q.last
+		if first < 0 {
+			first += n + 1
+		}
+		if last < 0 {
+			last += n + 1
+		}
+		if first < 1 {
+			first = 1
+		}
+		if last > n {
+			last = n
+		}
+		if first > last {
+			return nil
+		}
+		entries = entries[first-1 : last]
+	}
+
+	var result []string
+	for _, e := range entries {
+		result = append(result, e.path)
+	}
+	return result
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtglobGroupIsNotQualifier(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"x", "y", "pp", "a.c"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		src, want string
+	}{
+		{`echo D/!(x)`, "D/a.c D/d D/pp D/y\n"},
+		{`echo D/@(x)`, "D/x\n"},
+		{`echo D/+(p)`, "D/pp\n"},
+		{`echo D/*.c(.)`, "D/a.c\n"},
+		{`shopt -u extglob; echo D/*(/)`, "D/d\n"},
+	}
+	for _, tt := range tests {
+		src := strings.ReplaceAll(tt.src, "D/", dir+"/")
+		want := strings.ReplaceAll(tt.want, "D/", dir+"/")
+		if got := run(t, src); got != want {
+			t.Errorf("%s: got %q, want %q", tt.src, got, want)
+		}
+	}
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokOp
+	tokRedir
+	tokNewline
+	tokArith
+)
+
+type token struct {
+	kind  tokenKind
+	val   string
+	word  *Word
+	redir RedirectionType
+	fd    int
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "EOF"
+	case tokNewline:
+		return "newline"
+	case tokWord:
+		return wordText(t.word)
+	}
+	return t.val
+}
+
+type lexer struct {
+	src string
+	pos int
+	// pending holds here-documents whose bodies start after the next
+	// newline.
+	pending []*ReDirection
+	// comments makes '#' at the start of a word begin a comment.
+	comments bool
+	// heredoc makes a backslash before '"' literal, as in the body of an
+	// unquoted here-document.
+	heredoc bool
+}
+
+// incompleteError reports input that ends in the middle of a construct,
+// so that an interactive caller can read more lines and try again.
+type incompleteError struct {
+	msg string
+}
+
+func (e *incompleteError) Error() string {
+	return e.msg
+}
+
+func unexpectedEOF(match string) error {
+	return &incompleteError{fmt.Sprintf("unexpected EOF while looking for matching `%s'", match)}
+}
+
+func isIncomplete(err error) bool {
+	_, ok := err.(*incompleteError)
+	return ok
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isMeta reports whether c ends an unquoted word.
+func isMeta(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '|', '&', ';', '<', '>', '(', ')':
+		return true
+	}
+	return false
+}
+
+func (l *lexer) peekByte(off int) byte {
+	if l.pos+off < len(l.src) {
+		return l.src[l.pos+off]
+	}
+	return 0
+}
+
+func (l *lexer) skipBlanks() {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if isBlank(c) {
+			l.pos++
+		} else if c == '\\' && l.peekByte(1) == '\n' {
+			l.pos += 2
+		} else {
+			return
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipBlanks()
+	if l.comments && l.peekByte(0) == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		if len(l.pending) > 0 {
+			return token{}, l.unterminatedHereDoc(l.pending[0])
+		}
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	switch c := l.src[l.pos]; c {
+	case '\n':
+		l.pos++
+		if err := l.readHereDocs(); err != nil {
+			return token{}, err
+		}
+		return token{kind: tokNewline, pos: start}, nil
+	case '|', '&':
+		if c == '&' && l.peekByte(1) == '>' {
+			return l.lexRedir(start, -1), nil
+		}
+		l.pos++
+		if l.peekByte(0) == c || (c == '|' && l.peekByte(0) == '&') {
+			l.pos++
+		}
+		return token{kind: tokOp, val: l.src[start:l.pos], pos: start}, nil
+	case '(':
+		if l.peekByte(1) == '(' {
+			l.pos += 2
+			expr, err := l.lexArith()
+			if err != nil {
+				return token{}, err
+			}
+			return token{kind: tokArith, val: "((", word: expr, pos: start}, nil
+		}
+		l.pos++
+		return token{kind: tokOp, val: string(c), pos: start}, nil
+	case ';':
+		// ;; ;& and ;;& end the arms of a case.
+		l.pos++
+		if l.peekByte(0) == ';' {
+			l.pos++
+		}
+		if l.peekByte(0) == '&' {
+			l.pos++
+		}
+		return token{kind: tokOp, val: l.src[start:l.pos], pos: start}, nil
+	case ')':
+		l.pos++
+		return token{kind: tokOp, val: string(c), pos: start}, nil
+	case '<', '>':
+		if l.peekByte(1) != '(' {
+			return l.lexRedir(start, -1), nil
+		}
+	}
+
+	// A number directly before '<' or '>' names the descriptor to redirect.
+	if isDigit(l.src[l.pos]) {
+		end := l.pos
+		for end < len(l.src) && isDigit(l.src[end]) {
+			end++
+		}
+		if end < len(l.src) && (l.src[end] == '<' || l.src[end] == '>') {
+			if fd, err := strconv.Atoi(l.src[l.pos:end]); err == nil {
+				l.pos = end
+				return l.lexRedir(start, fd), nil
+			}
+		}
+	}
+
+	word, err := l.lexWord()
+	if err != nil {
+		return token{}, err
+	}
+	return token{kind: tokWord, word: word, pos: start}, nil
+}
+
+// lexRedir reads a redirection operator at l.pos. fd is the descriptor
+// written before it, or -1 for the operator's default.
+func (l *lexer) lexRedir(start, fd int) token {
+	typ := RedirOut
+	for _, r := range redirOps {
+		if strings.HasPrefix(l.src[l.pos:], r.op) {
+			typ = r.typ
+			l.pos += len(r.op)
+			break
+		}
+	}
+	if fd < 0 {
+		fd = typ.defaultFd()
+	}
+	return token{kind: tokRedir, val: l.src[start:l.pos], redir: typ, fd: fd, pos: start}
+}
+
+// readHereDocs reads the bodies of the pending here-documents from the
+// lines following the newline just consumed.
+func (l *lexer) readHereDocs() error {
+	for len(l.pending) > 0 {
+		r := l.pending[0]
+		delim := wordText(r.Target)
+		var body strings.Builder
+		for {
+			if l.pos >= len(l.src) {
+				return l.unterminatedHereDoc(r)
+			}
+			line, rest, found := strings.Cut(l.src[l.pos:], "\n")
+			if r.Type == RedirHereDocStrip {
+				line = strings.TrimLeft(line, "\t")
+			}
+			l.pos = len(l.src) - len(rest)
+			if line == delim {
+				break
+			}
+			if !found {
+				return l.unterminatedHereDoc(r)
+			}
+			body.WriteString(line + "\n")
+		}
+		l.pending = l.pending[1:]
+
+		if isQuotedWord(r.Target) {
+			r.Body = &Word{Parts: []WordPart{&SglQuoted{Value: body.String()}}}
+			continue
+		}
+		sub := &lexer{src: body.String(), heredoc: true}
+		parts, err := sub.lexDblParts(func(byte) bool { return false })
+		if err != nil {
+			return err
+		}
+		r.Body = &Word{Parts: []WordPart{&DblQuoted{Parts: parts}}}
+	}
+	return nil
+}
+
+func (l *lexer) unterminatedHereDoc(r *ReDirection) error {
+	return &incompleteError{fmt.Sprintf("unexpected EOF while looking for here-document delimiter `%s'", wordText(r.Target))}
+}
+
+// isQuotedWord reports whether any part of w is quoted, which for a
+// here-document delimiter turns off expansion of the body.
+func isQuotedWord(w *Word) bool {
+	for _, part := range w.Parts {
+		switch part.(type) {
+		case *SglQuoted, *DblQuoted:
+			return true
+		}
+	}
+	return false
+}
+
+// partsBuilder collects word parts, merging adjacent literal bytes.
+type partsBuilder struct {
+	parts []WordPart
+	lit   strings.Builder
+}
+
+func (b *partsBuilder) add(part WordPart) {
+	b.flush()
+	b.parts = append(b.parts, part)
+}
+
+func (b *partsBuilder) flush() {
+	if b.lit.Len() > 0 {
+		b.parts = append(b.parts, &Lit{Value: b.lit.String()})
+		b.lit.Reset()
+	}
+}
+
+func (b *partsBuilder) done() []WordPart {
+	b.flush()
+	return b.parts
+}
+
+func (l *lexer) lexWord() (*Word, error) {
+	parts, err := l.lexParts(isMeta)
+	if err != nil {
+		return nil, err
+	}
+	return &Word{Parts: parts}, nil
+}
+
+// lexParts reads unquoted word parts up to the first unquoted byte for
+// which stop returns true, or the end of input.
+func (l *lexer) lexParts(stop func(byte) bool) ([]WordPart, error) {
+	var b partsBuilder
+
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '(' && (b.lit.Len() > 0 || len(b.parts) > 0) && l.peekByte(1) != ')':
+			// A group inside a word holds glob qualifiers, as in *.go(om).
+			group, err := l.lexGroup(l.pos)
+			if err != nil {
+				return nil, err
+			}
+			b.lit.WriteString(group)
+
+		case (c == '<' || c == '>') && l.peekByte(1) == '(':
+			l.pos += 2
+			subst, err := l.lexCmdSubst()
+			if err != nil {
+				return nil, err
+			}
+			b.add(&ProcSubst{List: subst.List, Out: c == '>'})
+
+		case stop(c):
+			return b.done(), nil
+
+		case c == '\\':
+			l.pos++
+			if l.pos >= len(l.src) {
+				// A trailing backslash continues the line.
+				return nil, &incompleteError{"unexpected EOF after `\\'"}
+			}
+			if l.src[l.pos] == '\n' {
+				l.pos++
+				continue
+			}
+			_, size := utf8.DecodeRuneInString(l.src[l.pos:])
+			b.add(&SglQuoted{Value: l.src[l.pos : l.pos+size]})
+			l.pos += size
+
+		case c == '\'':
+			end := strings.IndexByte(l.src[l.pos+1:], '\'')
+			if end < 0 {
+				return nil, unexpectedEOF("'")
+			}
+			b.add(&SglQuoted{Value: l.src[l.pos+1 : l.pos+1+end]})
+			l.pos += end + 2
+
+		case c == '"':
+			l.pos++
+			parts, err := l.lexDblParts(func(c byte) bool { return c == '"' })
+			if err != nil {
+				return nil, err
+			}
+			if l.pos >= len(l.src) {
+				return nil, unexpectedEOF("\"")
+			}
+			l.pos++
+			b.add(&DblQuoted{Parts: parts})
+
+		case isExtglobOp(rune(c)) && l.peekByte(1) == '(':
+			group, err := l.lexGroup(l.pos + 1)
+			if err != nil {
+				return nil, err
+			}
+			b.lit.WriteString(group)
+
+		case c == '`':
+			part, err := l.lexBackquote(false)
+			if err != nil {
+				return nil, err
+			}
+			b.add(part)
+
+		case c == '$':
+			part, err := l.lexDollar()
+			if err != nil {
+				return nil, err
+			}
+			if part == nil {
+				b.lit.WriteByte(c)
+				l.pos++
+			} else {
+				b.add(part)
+			}
+
+		default:
+			b.lit.WriteByte(c)
+			l.pos++
+		}
+	}
+
+	return b.done(), nil
+}
+
+// lexDblParts reads parts with double-quote rules up to the first byte for
+// which stop returns true, leaving l.pos on it.
+func (l *lexer) lexDblParts(stop func(byte) bool) ([]WordPart, error) {
+	var b partsBuilder
+
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case stop(c):
+			return b.done(), nil
+
+		case c == '\\':
+			switch next := l.peekByte(1); next {
+			case '\\', '"', '$', '`':
+				if next == '"' && l.heredoc {
+					b.lit.WriteByte(c)
+					l.pos++
+					continue
+				}
+				b.lit.WriteByte(next)
+				l.pos += 2
+			case '\n':
+				l.pos += 2
+			default:
+				b.lit.WriteByte(c)
+				l.pos++
+			}
+
+		case c == '`':
+			part, err := l.lexBackquote(true)
+			if err != nil {
+				return nil, err
+			}
+			b.add(part)
+
+		case c == '$':
+			part, err := l.lexDollar()
+			if err != nil {
+				return nil, err
+			}
+			if part == nil {
+				b.lit.WriteByte(c)
+				l.pos++
+			} else {
+				b.add(part)
+			}
+
+		default:
+			b.lit.WriteByte(c)
+			l.pos++
+		}
+	}
+
+	return b.done(), nil
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || isDigit(c)
+}
+
+func isSpecialParam(c byte) bool {
+	return strings.IndexByte("?$#@*!-0", c) >= 0
+}
+
+func isValidName(s string) bool {
+	if s == "" || !isNameStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isNameChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// lexName reads a parameter name at l.pos: an identifier, a positional
+// digit or a special parameter. It returns "" if there is none.
+func (l *lexer) lexName(braced bool) string {
+	start := l.pos
+	c := l.peekByte(0)
+	switch {
+	case isNameStart(c):
+		for l.pos < len(l.src) && isNameChar(l.src[l.pos]) {
+			l.pos++
+		}
+	case isDigit(c):
+		l.pos++
+		for braced && l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+	case isSpecialParam(c):
+		l.pos++
+	}
+	return l.src[start:l.pos]
+}
+
+// lexDollar reads an expansion starting at '$'. It returns nil without
+// consuming anything when the '$' is literal.
+func (l *lexer) lexDollar() (WordPart, error) {
+	switch l.peekByte(1) {
+	case '{':
+		return l.lexBracedParam()
+	case '(':
+		if l.peekByte(2) == '(' {
+			l.pos += 3
+			expr, err := l.lexArith()
+			if err != nil {
+				return nil, err
+			}
+			return &ArithExp{Expr: expr}, nil
+		}
+		l.pos += 2
+		return l.lexCmdSubst()
+	}
+
+	l.pos++
+	name := l.lexName(false)
+	if name == "" {
+		l.pos--
+		return nil, nil
+	}
+	return &ParamExp{Name: name}, nil
+}
+
+// lexGroup reads a pattern group such as @(a|b) whose '(' is at open,
+// returning its text from l.pos. Metacharacters inside the parentheses do
+// not end the word, but a group must close on its own line, so an
+// unbalanced '(' is a syntax error rather than incomplete input.
+func (l *lexer) lexGroup(open int) (string, error) {
+	depth := 0
+	for i := open; i < len(l.src) && l.src[i] != '\n'; i++ {
+		switch l.src[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				text := l.src[l.pos : i+1]
+				l.pos = i + 1
+				return text, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("syntax error near unexpected token `('")
+}
+
+// lexArith reads the expression of $((...)) or ((...)) with l.pos just
+// after the opening parentheses, leaving l.pos after the closing ones.
+// Parentheses inside the expression must balance.
+func (l *lexer) lexArith() (*Word, error) {
+	depth := 0
+	parts, err := l.lexDblParts(func(c byte) bool {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return true
+			}
+			depth--
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if l.pos >= len(l.src) {
+		return nil, unexpectedEOF("))")
+	}
+	if l.peekByte(1) != ')' {
+		return nil, fmt.Errorf("syntax error: expected `))' after arithmetic expression")
+	}
+	l.pos += 2
+	return &Word{Parts: parts}, nil
+}
+
+// lexCmdSubst parses the command list of $(...) with l.pos just after the
+// opening parenthesis, leaving l.pos after the closing one.
+func (l *lexer) lexCmdSubst() (*CmdSubst, error) {
+	p := &parser{lex: &lexer{src: l.src, pos: l.pos, comments: l.comments}}
+	list, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tok.kind == tokEOF {
+		return nil, unexpectedEOF(")")
+	}
+	if tok.kind != tokOp || tok.val != ")" {
+		return nil, p.unexpected(tok)
+	}
+	l.pos = p.lex.pos
+	return &CmdSubst{List: list}, nil
+}
+
+// lexBackquote reads an old-style `...` substitution. Backslash only
+// escapes '$', '`' and '\' inside it (and '"' when within double quotes);
+// the unescaped text is then parsed on its own.
+func (l *lexer) lexBackquote(dq bool) (*CmdSubst, error) {
+	var inner strings.Builder
+	l.pos++
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '`':
+			l.pos++
+			list, err := parse(inner.String(), l.comments)
+			if isIncomplete(err) {
+				// The backquotes are closed, so more input cannot
+				// finish the command inside them.
+				return nil, fmt.Errorf("%v", err)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &CmdSubst{List: list}, nil
+		case c == '\\' && (strings.IndexByte("$`\\", l.peekByte(1)) >= 0 || (dq && l.peekByte(1) == '"')):
+			inner.WriteByte(l.peekByte(1))
+			l.pos += 2
+		default:
+			inner.WriteByte(c)
+			l.pos++
+		}
+	}
+	return nil, unexpectedEOF("`")
+}
+
+// paramOps lists the ${NAME<op>...} operators, longest first so that a
+// prefix such as ":" does not shadow ":-".
+var paramOps = []string{
+	":-", ":=", ":+", ":?", "-", "=", "+", "?",
+	"##", "#", "%%", "%", "//", "/#", "/%", "/",
+	"^^", "^", ",,", ",", ":",
+}
+
+// lexBracedParam reads ${...} starting at the '$'.
+func (l *lexer) lexBracedParam() (*ParamExp, error) {
+	l.pos += 2
+	pe := &ParamExp{}
+	if l.peekByte(0) == '#' && l.peekByte(1) != '}' {
+		pe.Length = true
+		l.pos++
+	}
+	pe.Name = l.lexName(true)
+	if l.pos >= len(l.src) {
+		return nil, unexpectedEOF("}")
+	}
+	if pe.Name == "" {
+		return nil, l.badSubstitution()
+	}
+
+	if l.peekByte(0) != '}' {
+		if pe.Length {
+			return nil, l.badSubstitution()
+		}
+		for _, op := range paramOps {
+			if strings.HasPrefix(l.src[l.pos:], op) {
+				pe.Op = op
+				l.pos += len(op)
+				break
+			}
+		}
+		if pe.Op == "" {
+			return nil, l.badSubstitution()
+		}
+
+		// Replacement and substring operators take a second word after a
+		// separator: ${NAME/pattern/string} and ${NAME:offset:length}.
+		var sep byte
+		switch pe.Op {
+		case "/", "//", "/#", "/%":
+			sep = '/'
+		case ":":
+			sep = ':'
+		}
+		stop := func(c byte) bool { return c == '}' || (sep != 0 && c == sep) }
+
+		arg, err := l.lexParamWord(stop)
+		if err != nil {
+			return nil, err
+		}
+		pe.Arg = arg
+
+		if sep != 0 && l.peekByte(0) == sep {
+			l.pos++
+			arg2, err := l.lexParamWord(func(c byte) bool { return c == '}' })
+			if err != nil {
+				return nil, err
+			}
+			pe.Arg2 = arg2
+		}
+	}
+
+	if l.pos >= len(l.src) {
+		return nil, unexpectedEOF("}")
+	}
+	l.pos++
+	return pe, nil
+}
+
+// lexParamWord reads the word argument of a ${...} operator. Quotes in it
+// are removed as in any word, also when the expansion is double-quoted.
+func (l *lexer) lexParamWord(stop func(byte) bool) (*Word, error) {
+	parts, err := l.lexParts(stop)
+	if err != nil {
+		return nil, err
+	}
+	return &Word{Parts: parts}, nil
+}
+
+func (l *lexer) badSubstitution() error {
+	end := strings.IndexByte(l.src[l.pos:], '}')
+	start := strings.LastIndex(l.src[:l.pos], "${")
+	if end < 0 || start < 0 {
+		return fmt.Errorf("bad substitution")
+	}
+	return fmt.Errorf("%s: bad substitution", l.src[start:l.pos+end+1])
+}
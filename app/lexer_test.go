@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestIncompleteInput(t *testing.T) {
+	tests := []struct {
+		src        string
+		incomplete bool
+	}{
+		{`echo "${x`, true},
+		{`echo ${`, true},
+		{`echo ${x:-a`, true},
+		{"echo `echo |`", false},
+		{`echo a(b`, false},
+		{`echo @(a|b`, false},
+	}
+	for _, tt := range tests {
+		_, err := parse(tt.src, true)
+		if err == nil {
+			t.Errorf("%s: parsed without error", tt.src)
+			continue
+		}
+		if got := isIncomplete(err); got != tt.incomplete {
+			t.Errorf("%s: incomplete = %v (%v), want %v", tt.src, got, err, tt.incomplete)
+		}
+	}
+}
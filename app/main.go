@@ -2,21 +2,32 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/chzyer/readline"
 )
 var builtinCommands = []string {
-		"echo", "exit", "type", "pwd", "cd",
+		"echo", "exit", "type", "pwd", "cd", "export", "unset", "shopt", "let", "set", "exec",
+		"break", "continue", "return", "local", "declare", ":", "true", "false",
+		"shift",
 }
 var _ = fmt.Fprint
 
+// execPathCache is shared by the concurrent stages of a pipeline, so it is
+// only used with execPathMu held.
 var execPathCache = make(map[string]string)
+var execPathMu sync.Mutex
 
 func findExecPath(command string) string {
+	execPathMu.Lock()
+	defer execPathMu.Unlock()
 
 	if path, exists := execPathCache[command]; exists {
 		return path
@@ -31,69 +42,11 @@ func findExecPath(command string) string {
 	return path
 }
 
-func parseCommand(input string) (string, []string) {
-	
-	if input == "" {
-		return "", []string{}
-	}
-
-	var result []string
-	var current strings.Builder
-	inSingleQuote := false
-	inDoubleQuote := false
-	escapeNext := false
-
-	for i := 0; i < len(input); i++ {
-		char := rune(input[i])
-
-		switch {
-		
-		case escapeNext:
-
-			if inDoubleQuote || inSingleQuote {
-				if char == '\\' || char == '"' || char == '$' {
-					current.WriteRune(char)
-				} else {
-					current.WriteRune('\\')
-					current.WriteRune(char)
-				}
-			} else {
-				current.WriteRune(char)
-			}
-			escapeNext = false
-		
-		case char == '\\':
-			if inSingleQuote {
-				current.WriteRune('\\')
-			} else {
-				escapeNext = true
-			}
-			
-		case char == '\'' && !inDoubleQuote:
-			inSingleQuote = !inSingleQuote
-
-		case char == '"' && !inSingleQuote:
-			inDoubleQuote = !inDoubleQuote
-
-		case char == ' ' && !inSingleQuote && !inDoubleQuote:
-			if current.Len() > 0 {
-				result = append(result, current.String())
-				current.Reset()
-			}
-
-		default:
-			current.WriteRune(char)
-		}		
-	} 
-
-	if current.Len() > 0 {
-		result = append(result, current.String())
-	}
-
-	if len(result) == 0 {
-		return "",[]string{}
-	}
-	return result[0], result[1:]
+// clearExecPathCache forgets the looked up paths, as when PATH changes.
+func clearExecPathCache() {
+	execPathMu.Lock()
+	execPathCache = make(map[string]string)
+	execPathMu.Unlock()
 }
 
 func isBuiltinCommand(cmd string) bool {
@@ -106,41 +59,46 @@ func isBuiltinCommand(cmd string) bool {
 }
 
 
-func executeBuiltinCommand(cmd string, args []string) error {
+func (sh *shell) executeBuiltinCommand(cmd string, args []string, s streams) error {
     switch cmd {
     case "echo":
         
         
-        fmt.Fprintln(os.Stdout, strings.Join(args, " "))
+        if s.stdout == nil {
+            fmt.Fprintln(s.stderr, "echo: write error: Bad file descriptor")
+            return exitStatus(1)
+        }
+        fmt.Fprintln(s.stdout, strings.Join(args, " "))
         
     case "type":
         if len(args) == 0 {
-            fmt.Fprintln(os.Stdout, "type: missing argument")
+            fmt.Fprintln(s.stdout, "type: missing argument")
             return fmt.Errorf("missing argument")
         }
         
         typeCommand := args[0]
+        if fn, ok := sh.funcs[typeCommand]; ok {
+            fmt.Fprintln(s.stdout, typeCommand + " is a function")
+            fmt.Fprintln(s.stdout, fn.Source)
+            return nil
+        }
         for _, builtinCmd := range builtinCommands {
             if builtinCmd == typeCommand {
-                fmt.Fprintln(os.Stdout, typeCommand + " is a shell builtin")
+                fmt.Fprintln(s.stdout, typeCommand + " is a shell builtin")
                 return nil
             }
         }
         
         execPath := findExecPath(typeCommand)
         if execPath != "" {
-            fmt.Fprintln(os.Stdout, typeCommand + " is " + execPath)
+            fmt.Fprintln(s.stdout, typeCommand + " is " + execPath)
         } else {
-            fmt.Fprintln(os.Stdout, typeCommand + ": not found")
+            fmt.Fprintln(s.stdout, typeCommand + ": not found")
+            return fmt.Errorf("%s: not found", typeCommand)
         }
         
     case "pwd":
-        dir, err := os.Getwd()
-        if err != nil {
-            fmt.Fprintf(os.Stderr, "pwd: %v\n", err)
-            return err
-        }
-        fmt.Fprintln(os.Stdout, dir)
+        fmt.Fprintln(s.stdout, sh.dir)
         
     case "cd":
         
@@ -149,284 +107,352 @@ func executeBuiltinCommand(cmd string, args []string) error {
         }
         
         dir := args[0]
-        if dir == "~" {
-            homeDir, err := os.UserHomeDir()
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "cd: could not find home directory: %v\n", err)
-                return err
+        newDir := filepath.Clean(sh.abs(dir))
+        info, err := os.Stat(newDir)
+        if err != nil {
+            fmt.Fprintf(s.stderr, "cd: %s: No such file or directory\n", dir)
+            return exitStatus(1)
+        }
+        if !info.IsDir() {
+            fmt.Fprintf(s.stderr, "cd: %s: Not a directory\n", dir)
+            return exitStatus(1)
+        }
+        if sh.toplevel {
+            if err := os.Chdir(newDir); err != nil {
+                fmt.Fprintf(s.stderr, "cd: %s: Permission denied\n", dir)
+                return exitStatus(1)
             }
-            dir = homeDir
         }
+        sh.setVar("OLDPWD", sh.dir)
+        sh.setVar("PWD", newDir)
+        sh.dir = newDir
         
-        err := os.Chdir(dir)
+    case "exit":
+        if len(args) == 0 {
+            return shellExit(sh.lastStatus)
+        }
+        code, err := strconv.Atoi(args[0])
         if err != nil {
-            fmt.Fprintf(os.Stderr, "cd: %s: No such file or directory\n", dir)
-            return err
+            fmt.Fprintf(s.stderr, "exit: %s: numeric argument required\n", args[0])
+            return shellExit(2)
         }
+        return shellExit(code & 0xff)
         
-    case "exit":
-        os.Exit(0)
-        
-    default:
-        return fmt.Errorf("unknown builtin command: %s", cmd)
-    }
-    
-    return nil
-}
+    case "export":
+        if len(args) == 0 {
+            for _, kv := range sh.environ(nil) {
+                name, value, _ := strings.Cut(kv, "=")
+                fmt.Fprintf(s.stdout, "declare -x %s=%q\n", name, value)
+            }
+            return nil
+        }
 
-func hasPipeline(input string) bool {
-    var inSingleQuote, inDoubleQuote bool
-    var escaped bool
-    
-    for i := 0; i < len(input); i++ {
-        c := input[i]
-        
-        if escaped {
-            escaped = false
-            continue
+        var err error
+        for _, arg := range args {
+            name, value, hasValue := strings.Cut(arg, "=")
+            if !isValidName(name) {
+                fmt.Fprintf(s.stderr, "export: `%s': not a valid identifier\n", arg)
+                err = exitStatus(1)
+                continue
+            }
+            if hasValue {
+                sh.setVar(name, value)
+            }
+            sh.exportVar(name)
         }
-        
-        if c == '\\' {
-            escaped = true
-            continue
+        return err
+
+    case "unset":
+        flag := ""
+        if len(args) > 0 && (args[0] == "-f" || args[0] == "-v") {
+            flag, args = args[0], args[1:]
         }
-        
-        if c == '\'' && !inDoubleQuote {
-            inSingleQuote = !inSingleQuote
-        } else if c == '"' && !inSingleQuote {
-            inDoubleQuote = !inDoubleQuote
-        } else if c == '|' && !inSingleQuote && !inDoubleQuote {
-            return true
+        for _, name := range args {
+            switch {
+            case flag == "-f":
+                delete(sh.funcs, name)
+            case flag == "" && sh.vars[name] == nil:
+                // A name that is not a variable may be a function.
+                delete(sh.funcs, name)
+            default:
+                sh.unsetVar(name)
+            }
         }
-    }
-    
-    return false
-}
 
-
-func splitByPipe(input string) []string {
-    var result []string
-    var current strings.Builder
-    var inSingleQuote, inDoubleQuote bool
-    var escaped bool
-    
-    for i := 0; i < len(input); i++ {
-        c := input[i]
-        
-        if escaped {
-            current.WriteByte(c)
-            escaped = false
-            continue
+    case "shopt":
+        flags := ""
+        for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+            flags += args[0][1:]
+            args = args[1:]
         }
-        
-        if c == '\\' {
-            current.WriteByte(c)
-            escaped = true
-            continue
+        set := strings.Contains(flags, "s")
+        unset := strings.Contains(flags, "u")
+        quiet := strings.Contains(flags, "q")
+
+        if len(args) == 0 {
+            for _, name := range shoptOptions {
+                on := sh.options[name]
+                if (set && !on) || (unset && on) {
+                    continue
+                }
+                fmt.Fprintf(s.stdout, "%-15s\t%s\n", name, onOff(on))
+            }
+            return nil
         }
-        
-        if c == '\'' && !inDoubleQuote {
-            current.WriteByte(c)
-            inSingleQuote = !inSingleQuote
-        } else if c == '"' && !inSingleQuote {
-            current.WriteByte(c)
-            inDoubleQuote = !inDoubleQuote
-        } else if c == '|' && !inSingleQuote && !inDoubleQuote {
-            result = append(result, current.String())
-            current.Reset()
-        } else {
-            current.WriteByte(c)
+
+        var err error
+        for _, name := range args {
+            if !isShoptOption(name) {
+                fmt.Fprintf(s.stderr, "shopt: %s: invalid shell option name\n", name)
+                err = exitStatus(1)
+                continue
+            }
+            switch {
+            case set:
+                sh.options[name] = true
+            case unset:
+                sh.options[name] = false
+            default:
+                if !quiet {
+                    fmt.Fprintf(s.stdout, "%-15s\t%s\n", name, onOff(sh.options[name]))
+                }
+                if !sh.options[name] {
+                    err = exitStatus(1)
+                }
+            }
         }
-    }
-    
-    if current.Len() > 0 {
-        result = append(result, current.String())
-    }
-    
-    return result
-}
+        return err
 
-func executeMultiPipeline(commands []string) error {
-    n := len(commands)
-    if n < 2 {
-        return fmt.Errorf("pipeline needs at least 2 commands")
-    }
-    
-    
-    pipes := make([][2]*os.File, n-1)
-    for i := 0; i < n-1; i++ {
-        pipeReader, pipeWriter, err := os.Pipe()
-        if err != nil {
-            for j := 0; j < i; j++ {
-                pipes[j][0].Close()
-                pipes[j][1].Close()
+    case "let":
+        if len(args) == 0 {
+            fmt.Fprintln(s.stderr, "let: expression expected")
+            return exitStatus(1)
+        }
+        var n int64
+        for _, arg := range args {
+            var err error
+            if n, err = sh.evalArith(arg); err != nil {
+                fmt.Fprintf(s.stderr, "let: %v\n", err)
+                return exitStatus(1)
             }
-            return fmt.Errorf("failed to create pipe: %v", err)
         }
-        pipes[i][0] = pipeReader
-        pipes[i][1] = pipeWriter
-    }
-    
-    
-    originalStdin := os.Stdin
-    originalStdout := os.Stdout
-    defer func() {
-        os.Stdin = originalStdin
-        os.Stdout = originalStdout
-    }()
-    
-    var wg sync.WaitGroup
-    
-    
-    errorCh := make(chan error, n)
-    
-    for i, cmdStr := range commands {
-        cmdStr = strings.TrimSpace(cmdStr)
-        cmdName, cmdArgs := parseCommand(cmdStr)
-        
-        
-        var stdin *os.File
-        if i == 0 {
-            stdin = os.Stdin
-        } else {
-            stdin = pipes[i-1][0]
+        if n == 0 {
+            return exitStatus(1)
         }
-        
-        
-        var stdout *os.File
-        if i == n-1 {
-            stdout = os.Stdout
-        } else {
-            stdout = pipes[i][1]
+
+    case "set":
+        if len(args) == 0 {
+            names := make([]string, 0, len(sh.vars))
+            for name := range sh.vars {
+                names = append(names, name)
+            }
+            sort.Strings(names)
+            for _, name := range names {
+                fmt.Fprintf(s.stdout, "%s=%s\n", name, sh.vars[name].value)
+            }
+            return nil
         }
-        
-        if isBuiltinCommand(cmdName) {
-            
-            
-            
-            if i == 0 {
-                
-                os.Stdin = stdin
-                
-                
-                oldStdout := os.Stdout
-                os.Stdout = stdout
-                
-                
-                err := executeBuiltinCommand(cmdName, cmdArgs)
-                
-                
-                os.Stdout = oldStdout
-                
-                
-                stdout.Close()
-                
-                if err != nil {
-                    cleanupPipes(pipes)
-                    return fmt.Errorf("command %d failed: %v", i, err)
-                }
-            } else if i == n-1 {
-                
-                os.Stdin = stdin
-                
-                
-                err := executeBuiltinCommand(cmdName, cmdArgs)
-                
-                if err != nil {
-                    cleanupPipes(pipes)
-                    return fmt.Errorf("command %d failed: %v", i, err)
+
+        for i := 0; i < len(args); i++ {
+            arg := args[i]
+            if arg == "--" {
+                // The remaining arguments become the positional parameters.
+                sh.params = append([]string(nil), args[i+1:]...)
+                return nil
+            }
+            if arg == "" || (arg[0] != '-' && arg[0] != '+') {
+                fmt.Fprintf(s.stderr, "set: %s: invalid option\n", arg)
+                return exitStatus(2)
+            }
+            on := arg[0] == '-'
+            switch {
+            case arg == "-o" || arg == "+o":
+                if i+1 == len(args) {
+                    for _, name := range setOptions {
+                        if on {
+                            fmt.Fprintf(s.stdout, "%-15s\t%s\n", name, onOff(sh.options[name]))
+                        } else if sh.options[name] {
+                            fmt.Fprintf(s.stdout, "set -o %s\n", name)
+                        } else {
+                            fmt.Fprintf(s.stdout, "set +o %s\n", name)
+                        }
+                    }
+                    return nil
                 }
-                
-                
-                stdin.Close()
-            } else {
-                
-                tempStdin := os.Stdin
-                tempStdout := os.Stdout
-                
-                os.Stdin = stdin
-                os.Stdout = stdout
-                
-                
-                err := executeBuiltinCommand(cmdName, cmdArgs)
-                
-                
-                os.Stdin = tempStdin
-                os.Stdout = tempStdout
-                
-                
-                stdin.Close()
-                stdout.Close()
-                
-                if err != nil {
-                    cleanupPipes(pipes)
-                    return fmt.Errorf("command %d failed: %v", i, err)
+                i++
+                if !containsString(setOptions, args[i]) {
+                    fmt.Fprintf(s.stderr, "set: %s: invalid option name\n", args[i])
+                    return exitStatus(2)
                 }
+                sh.options[args[i]] = on
+            case arg == "-C" || arg == "+C":
+                sh.options["noclobber"] = on
+            default:
+                fmt.Fprintf(s.stderr, "set: %s: invalid option\n", arg)
+                return exitStatus(2)
             }
-        } else {
-            
-            cmd := exec.Command(cmdName, cmdArgs...)
-            cmd.Stdin = stdin
-            cmd.Stdout = stdout
-            cmd.Stderr = os.Stderr
-            
-            err := cmd.Start()
-            if err != nil {
-                cleanupPipes(pipes)
-                return fmt.Errorf("failed to start command %d: %v", i, err)
+        }
+
+    case "shift":
+        n := 1
+        if len(args) > 0 {
+            var err error
+            if n, err = strconv.Atoi(args[0]); err != nil {
+                fmt.Fprintf(s.stderr, "shift: %s: numeric argument required\n", args[0])
+                return exitStatus(1)
             }
-            
-            
-            if i > 0 {
-                pipes[i-1][0].Close()
+            if n < 0 {
+                fmt.Fprintf(s.stderr, "shift: %s: shift count out of range\n", args[0])
+                return exitStatus(1)
             }
-            if i < n-1 {
-                pipes[i][1].Close()
+        }
+        if n > len(sh.params) {
+            return exitStatus(1)
+        }
+        sh.params = sh.params[n:]
+
+    case ":", "true":
+
+    case "false":
+        return exitStatus(1)
+
+    case "break", "continue":
+        n := 1
+        if len(args) > 0 {
+            var err error
+            if n, err = strconv.Atoi(args[0]); err != nil {
+                fmt.Fprintf(s.stderr, "%s: %s: numeric argument required\n", cmd, args[0])
+                return exitStatus(1)
             }
-            
-            
-            wg.Add(1)
-            go func(cmd *exec.Cmd, index int) {
-                defer wg.Done()
-                err := cmd.Wait()
-                if err != nil {
-                    errorCh <- fmt.Errorf("command %d failed: %v", index, err)
+            if n < 1 {
+                fmt.Fprintf(s.stderr, "%s: %s: loop count out of range\n", cmd, args[0])
+                return exitStatus(1)
+            }
+        }
+        if sh.loopDepth == 0 {
+            fmt.Fprintf(s.stderr, "%s: only meaningful in a `for', `while', or `until' loop\n", cmd)
+            return nil
+        }
+        if n > sh.loopDepth {
+            n = sh.loopDepth
+        }
+        return loopControl{n: n, cont: cmd == "continue"}
+
+    case "return":
+        if len(sh.scopes) == 0 {
+            fmt.Fprintln(s.stderr, "return: can only `return' from a function")
+            return exitStatus(1)
+        }
+        if len(args) == 0 {
+            return funcReturn(sh.lastStatus)
+        }
+        code, err := strconv.Atoi(args[0])
+        if err != nil {
+            fmt.Fprintf(s.stderr, "return: %s: numeric argument required\n", args[0])
+            return funcReturn(2)
+        }
+        return funcReturn(code & 0xff)
+
+    case "local":
+        if len(sh.scopes) == 0 {
+            fmt.Fprintln(s.stderr, "local: can only be used in a function")
+            return exitStatus(1)
+        }
+        return sh.declareVars("local", args, s)
+
+    case "declare":
+        if len(args) > 0 && args[0] == "-f" {
+            names := args[1:]
+            if len(names) == 0 {
+                for name := range sh.funcs {
+                    names = append(names, name)
+                }
+                sort.Strings(names)
+            }
+            var err error
+            for _, name := range names {
+                fn, ok := sh.funcs[name]
+                if !ok {
+                    err = exitStatus(1)
+                    continue
                 }
-            }(cmd, i)
+                fmt.Fprintln(s.stdout, fn.Source)
+            }
+            return err
         }
-    }
-    
-    
-    wg.Wait()
-    
-    
-    select {
-    case err := <-errorCh:
-        return err
+        if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+            fmt.Fprintf(s.stderr, "declare: %s: invalid option\n", args[0])
+            return exitStatus(2)
+        }
+        return sh.declareVars("declare", args, s)
+
     default:
-        
+        return fmt.Errorf("unknown builtin command: %s", cmd)
     }
     
     return nil
 }
 
+// declareVars sets the NAME[=value] arguments of local and declare. Inside
+// a function the variables are local to it.
+func (sh *shell) declareVars(cmd string, args []string, s streams) error {
+    if len(args) == 0 {
+        names := make([]string, 0, len(sh.vars))
+        for name := range sh.vars {
+            if len(sh.scopes) == 0 || cmd == "declare" {
+                names = append(names, name)
+            } else if _, ok := sh.scopes[len(sh.scopes)-1][name]; ok {
+                names = append(names, name)
+            }
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            fmt.Fprintf(s.stdout, "%s=%s\n", name, sh.vars[name].value)
+        }
+        return nil
+    }
 
-func cleanupPipes(pipes [][2]*os.File) {
-    for _, pipe := range pipes {
-        if pipe[0] != nil {
-            pipe[0].Close()
+    var err error
+    for _, arg := range args {
+        name, value, hasValue := strings.Cut(arg, "=")
+        if !isValidName(name) {
+            fmt.Fprintf(s.stderr, "%s: `%s': not a valid identifier\n", cmd, arg)
+            err = exitStatus(1)
+            continue
         }
-        if pipe[1] != nil {
-            pipe[1].Close()
+        if len(sh.scopes) > 0 {
+            sh.makeLocal(name)
+        }
+        if hasValue {
+            sh.setVar(name, value)
+        }
+    }
+    return err
+}
+
+func isShoptOption(name string) bool {
+    for _, opt := range shoptOptions {
+        if opt == name {
+            return true
         }
     }
+    return false
+}
+
+func onOff(on bool) string {
+    if on {
+        return "on"
+    }
+    return "off"
 }
+
 func main() {
 	rl, err := readline.NewEx(&readline.Config {
 		Prompt: "$ ",
 		AutoComplete: &shellCompleter{},
 		InterruptPrompt: "^C",
 		EOFPrompt: "exit",
+		DisableAutoSaveHistory: true,
 	})
 
 	if err != nil {
@@ -434,172 +460,58 @@ func main() {
 		os.Exit(1)
 	}
 
-	defer rl.Close()
+	sh := newShell()
 
 	for {
 		
-		line, _ := rl.Readline()
+		line, err := rl.Readline()
+		if err == io.EOF {
+			rl.Close()
+			os.Exit(sh.lastStatus)
+		}
 		line = strings.TrimSpace((line))
 
 		if line == "" {
 			continue
 		}
 
-		if hasPipeline(line) {
-			commands := splitByPipe(line)
-			err := executeMultiPipeline(commands)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "pipeline error: %v\n", err)
+		list, err := parse(line, sh.options["interactive_comments"])
+		for isIncomplete(err) {
+			// Keep reading lines, such as here-document bodies or the
+			// rest of a quoted string, until the input parses.
+			ps2, ok := sh.lookupVar("PS2")
+			if !ok {
+				ps2 = "> "
 			}
-			continue
-		}
-		cmdString, redirections := extractRedirection(line)
-		commandName, args := parseCommand(cmdString)
-
-		var originalStdout, originalStderr *os.File
-		var stdoutFile, stderrFile *os.File
-
-		for _, r := range redirections {
-			var err error 
-			var flags int
-
-			switch r.Type {
-			
-			case RedirOut:
-				flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
-				originalStdout = os.Stdout
-				stdoutFile, err = os.OpenFile(r.FilePath, flags, 0644)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "redirection error: %v\n", err)
-					continue
-				}
-				os.Stdout = stdoutFile
-				
-				
-			case RedirOutAppend:
-				flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
-				originalStdout = os.Stdout
-				stdoutFile, err = os.OpenFile(r.FilePath, flags, 0644)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "redirection error: %v\n", err)
-					continue
-				}
-				os.Stdout = stdoutFile
-				
-			case RedirErr:
-				flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
-				originalStderr = os.Stderr
-				stderrFile, err = os.OpenFile(r.FilePath, flags, 0644)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "redirection error: %v\n", err)
-					continue
-				}
-				os.Stderr = stderrFile
-				
-				
-			case RedirErrAppend:
-				flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
-				originalStderr = os.Stderr
-				stderrFile, err = os.OpenFile(r.FilePath, flags, 0644)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "redirection error: %v\n", err)
-					continue
-				}
-				os.Stderr = stderrFile
+			rl.SetPrompt(ps2)
+			more, readErr := rl.Readline()
+			rl.SetPrompt("$ ")
+			if readErr == io.EOF {
+				fmt.Fprintln(os.Stderr, err)
+				rl.Close()
+				os.Exit(2)
 			}
-		} 
-
-		switch commandName {
-		
-		case "exit":
-			os.Exit(0)
-		
-		case "echo":
-
-			fmt.Println(strings.Join(args, " "))
-
-		case "type":
-			
-			if len(args) == 0 {
-				fmt.Println("type: missing arguement")
-				continue
-			}
-
-			typeCommand := args[0]
-			isBuiltin := false
-
-			for _, cmd := range builtinCommands {
-				if cmd == typeCommand {
-					isBuiltin = true
-					break
-				}
-			}
-
-
-			if isBuiltin {
-				fmt.Println(typeCommand + " is a shell builtin")
-			} else {
-				execPath := findExecPath(typeCommand)
-				if execPath != "" {
-					fmt.Println(typeCommand + " is " +  execPath)
-					continue
-				} else {
-					fmt.Println(typeCommand + ": not found")
-				}
-			}
-
-		case "pwd":
-			dir, err := os.Getwd()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "pwd: %v\n", err)
-			} else {
-				fmt.Println(dir)
-			}
-
-		case "cd":
-			if len(args) == 0 {
-				continue
-			}
-
-			if args[0] == "~" {
-				homeDir, err := os.UserHomeDir()
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "cd: could not find home directory: %v\n", err)
-					continue
-				}
-				err = os.Chdir(homeDir)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "cd: %s: %v\n", homeDir, err)
-				}
-				continue
-			}
-
-			dir := args[0]
-			err := os.Chdir(dir)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "cd: %s: No such file or directory\n", dir)
-			}
-
-		default:
-			execPath := findExecPath(commandName)
-
-			if execPath != "" {
-				cmd := exec.Command(commandName, args...)
-				cmd.Stdin = os.Stdin
-				cmd.Stdout = os.Stdout
-				cmd.Stderr = os.Stderr
-				cmd.Run()
-			} else {
-				fmt.Println(commandName + ": command not found")
+			if readErr != nil {
+				break
 			}
+			line += "\n" + more
+			list, err = parse(line, sh.options["interactive_comments"])
 		}
-		if stdoutFile != nil {
-			os.Stdout = originalStdout
-			stdoutFile.Close()
+		if isIncomplete(err) {
+			// ^C abandons the partial input.
+			continue
+		}
+		// The whole construct is one history entry.
+		rl.SaveHistory(line)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			sh.lastStatus = 2
+			continue
 		}
-		if stderrFile != nil {
-			os.Stderr = originalStderr
-			stderrFile.Close()
+		err = sh.executeList(list, sh.files)
+		if exit, ok := err.(shellExit); ok {
+			rl.Close()
+			os.Exit(int(exit))
 		}
 	}
 }
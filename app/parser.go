@@ -0,0 +1,707 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type parser struct {
+	lex    *lexer
+	tok    token
+	hasTok bool
+}
+
+func newParser(src string, comments bool) *parser {
+	return &parser{lex: &lexer{src: src, comments: comments}}
+}
+
+// parse parses a complete command line. With comments set, an unquoted '#'
+// at the start of a word begins a comment.
+func parse(src string, comments bool) (*List, error) {
+	p := newParser(src, comments)
+	list, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if tok, err := p.peek(); err != nil {
+		return nil, err
+	} else if tok.kind != tokEOF {
+		return nil, p.unexpected(tok)
+	}
+	return list, nil
+}
+
+// peek returns the current token, lexing it on first use. Lexing lazily
+// keeps the lexer position right after the last consumed token.
+func (p *parser) peek() (token, error) {
+	if !p.hasTok {
+		tok, err := p.lex.next()
+		if err != nil {
+			return token{}, err
+		}
+		p.tok = tok
+		p.hasTok = true
+	}
+	return p.tok, nil
+}
+
+func (p *parser) advance() {
+	p.hasTok = false
+}
+
+func (p *parser) unexpected(tok token) error {
+	if tok.kind == tokEOF {
+		return &incompleteError{"syntax error: unexpected end of file"}
+	}
+	return fmt.Errorf("syntax error near unexpected token `%s'", tok)
+}
+
+func (p *parser) skipNewlines() error {
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return err
+		}
+		if tok.kind != tokNewline {
+			return nil
+		}
+		p.advance()
+	}
+}
+
+func (p *parser) parseList() (*List, error) {
+	list := &List{}
+	for {
+		if err := p.skipNewlines(); err != nil {
+			return nil, err
+		}
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if !startsCommand(tok) || isReserved(tok, listTerminators...) {
+			return list, nil
+		}
+
+		item, err := p.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, item)
+
+		tok, err = p.peek()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case tok.kind == tokNewline:
+		case tok.kind == tokOp && tok.val == ";":
+			p.advance()
+		default:
+			return list, nil
+		}
+	}
+}
+
+func (p *parser) parseAndOr() (*AndOr, error) {
+	andOr := &AndOr{}
+	for {
+		pipeline, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		andOr.Pipelines = append(andOr.Pipelines, pipeline)
+
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind != tokOp || (tok.val != "&&" && tok.val != "||") {
+			return andOr, nil
+		}
+		p.advance()
+		andOr.Ops = append(andOr.Ops, tok.val)
+		if err := p.skipNewlines(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parsePipeline() (*Pipeline, error) {
+	pipeline := &Pipeline{}
+	for {
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		pipeline.Cmds = append(pipeline.Cmds, cmd)
+
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind != tokOp || (tok.val != "|" && tok.val != "|&") {
+			return pipeline, nil
+		}
+		p.advance()
+		if tok.val == "|&" {
+			// |& is short for 2>&1 |, applied after the stage's own
+			// redirections.
+			if redirs := commandRedirs(cmd); redirs != nil {
+				*redirs = append(*redirs, &ReDirection{
+					Fd:     2,
+					Type:   RedirDupOut,
+					Target: &Word{Parts: []WordPart{&Lit{Value: "1"}}},
+				})
+			}
+		}
+		if err := p.skipNewlines(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// startsCommand reports whether tok can begin a command.
+func startsCommand(tok token) bool {
+	switch tok.kind {
+	case tokWord, tokRedir, tokArith:
+		return true
+	case tokOp:
+		return tok.val == "("
+	}
+	return false
+}
+
+// listTerminators are the reserved words that end a command list when they
+// appear where a command would start.
+var listTerminators = []string{"}", "then", "elif", "else", "fi", "do", "done", "esac"}
+
+// isReserved reports whether tok is an unquoted word spelled as one of
+// words. Reserved words are only recognized where a command starts.
+func isReserved(tok token, words ...string) bool {
+	if tok.kind != tokWord || len(tok.word.Parts) != 1 {
+		return false
+	}
+	lit, ok := tok.word.Parts[0].(*Lit)
+	return ok && containsString(words, lit.Value)
+}
+
+// commandRedirs returns the redirection list of a command, or nil for one
+// that takes none.
+func commandRedirs(cmd Command) *[]*ReDirection {
+	switch cmd := cmd.(type) {
+	case *SimpleCommand:
+		return &cmd.Redirs
+	case *ArithCommand:
+		return &cmd.Redirs
+	case *Subshell:
+		return &cmd.Redirs
+	case *BraceGroup:
+		return &cmd.Redirs
+	case *IfClause:
+		return &cmd.Redirs
+	case *WhileClause:
+		return &cmd.Redirs
+	case *ForClause:
+		return &cmd.Redirs
+	case *ArithForClause:
+		return &cmd.Redirs
+	case *CaseClause:
+		return &cmd.Redirs
+	}
+	return nil
+}
+
+func (p *parser) parseCommand() (Command, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	var cmd Command
+	switch {
+	case tok.kind == tokArith:
+		p.advance()
+		cmd = &ArithCommand{Expr: tok.word}
+	case tok.kind == tokOp && tok.val == "(":
+		p.advance()
+		list, _, err := p.parseCompoundList(")")
+		if err != nil {
+			return nil, err
+		}
+		cmd = &Subshell{List: list}
+	case isReserved(tok, "{"):
+		p.advance()
+		list, _, err := p.parseCompoundList("}")
+		if err != nil {
+			return nil, err
+		}
+		cmd = &BraceGroup{List: list}
+	case isReserved(tok, "if"):
+		cmd, err = p.parseIf()
+	case isReserved(tok, "while", "until"):
+		cmd, err = p.parseWhile()
+	case isReserved(tok, "for"):
+		cmd, err = p.parseFor()
+	case isReserved(tok, "case"):
+		cmd, err = p.parseCase()
+	case isReserved(tok, "function"):
+		p.advance()
+		name, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if name.kind != tokWord {
+			return nil, p.unexpected(name)
+		}
+		p.advance()
+		return p.parseFuncDef(wordText(name.word), tok.pos, true)
+	default:
+		simple, err := p.parseSimpleCommand()
+		if err != nil {
+			return nil, err
+		}
+		next, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if name, ok := funcName(simple); ok && next.kind == tokOp && next.val == "(" {
+			return p.parseFuncDef(name, tok.pos, false)
+		}
+		return simple, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.parseRedirs(commandRedirs(cmd)); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// funcName returns the name of a function being defined when cmd, read up
+// to a following "(", is a lone unquoted word.
+func funcName(cmd *SimpleCommand) (string, bool) {
+	if len(cmd.Args) != 1 || len(cmd.Assigns) != 0 || len(cmd.Redirs) != 0 {
+		return "", false
+	}
+	parts := cmd.Args[0].Parts
+	if len(parts) != 1 {
+		return "", false
+	}
+	lit, ok := parts[0].(*Lit)
+	if !ok {
+		return "", false
+	}
+	return lit.Value, true
+}
+
+// parseFuncDef parses a function definition from the "()" after its name,
+// which the function keyword makes optional. start is the offset of the
+// definition in the source.
+func (p *parser) parseFuncDef(name string, start int, optionalParens bool) (*FuncDef, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tok.kind == tokOp && tok.val == "(" {
+		p.advance()
+		if tok, err = p.peek(); err != nil {
+			return nil, err
+		}
+		if tok.kind != tokOp || tok.val != ")" {
+			return nil, p.unexpected(tok)
+		}
+		p.advance()
+	} else if !optionalParens {
+		return nil, p.unexpected(tok)
+	}
+
+	if err := p.skipNewlines(); err != nil {
+		return nil, err
+	}
+	if tok, err = p.peek(); err != nil {
+		return nil, err
+	}
+	body, err := p.parseCommand()
+	if err != nil {
+		return nil, err
+	}
+	switch body.(type) {
+	case *SimpleCommand, *FuncDef:
+		return nil, p.unexpected(tok)
+	}
+
+	// The lexer has read up to the token after the body.
+	end := p.lex.pos
+	if p.hasTok {
+		end = p.tok.pos
+	}
+	source := strings.TrimSpace(p.lex.src[start:end])
+	return &FuncDef{Name: name, Body: body, Source: source}, nil
+}
+
+// parseCompoundList parses the non-empty list of a compound command and the
+// word or operator that closes it, one of ends, which it returns.
+func (p *parser) parseCompoundList(ends ...string) (*List, string, error) {
+	list, err := p.parseList()
+	if err != nil {
+		return nil, "", err
+	}
+	tok, err := p.peek()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(list.Items) == 0 || !(isReserved(tok, ends...) || (tok.kind == tokOp && containsString(ends, tok.val))) {
+		return nil, "", p.unexpected(tok)
+	}
+	p.advance()
+	if tok.kind == tokOp {
+		return list, tok.val, nil
+	}
+	return list, wordText(tok.word), nil
+}
+
+// expectReserved consumes the reserved word want or reports a syntax
+// error.
+func (p *parser) expectReserved(want string) error {
+	tok, err := p.peek()
+	if err != nil {
+		return err
+	}
+	if !isReserved(tok, want) {
+		return p.unexpected(tok)
+	}
+	p.advance()
+	return nil
+}
+
+func (p *parser) parseIf() (*IfClause, error) {
+	p.advance()
+	clause := &IfClause{}
+	for {
+		cond, _, err := p.parseCompoundList("then")
+		if err != nil {
+			return nil, err
+		}
+		body, end, err := p.parseCompoundList("elif", "else", "fi")
+		if err != nil {
+			return nil, err
+		}
+		clause.Conds = append(clause.Conds, cond)
+		clause.Bodies = append(clause.Bodies, body)
+
+		switch end {
+		case "else":
+			if clause.Else, _, err = p.parseCompoundList("fi"); err != nil {
+				return nil, err
+			}
+			return clause, nil
+		case "fi":
+			return clause, nil
+		}
+	}
+}
+
+func (p *parser) parseWhile() (*WhileClause, error) {
+	tok, _ := p.peek()
+	p.advance()
+	cond, _, err := p.parseCompoundList("do")
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := p.parseCompoundList("done")
+	if err != nil {
+		return nil, err
+	}
+	return &WhileClause{Cond: cond, Body: body, Until: isReserved(tok, "until")}, nil
+}
+
+// parseDoGroup parses "do list done", allowing newlines before the do.
+func (p *parser) parseDoGroup() (*List, error) {
+	if err := p.skipNewlines(); err != nil {
+		return nil, err
+	}
+	if err := p.expectReserved("do"); err != nil {
+		return nil, err
+	}
+	body, _, err := p.parseCompoundList("done")
+	return body, err
+}
+
+func (p *parser) parseFor() (Command, error) {
+	p.advance()
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.kind == tokArith {
+		p.advance()
+		exprs := splitArithFor(tok.word)
+		if len(exprs) != 3 {
+			return nil, fmt.Errorf("syntax error: arithmetic expression required")
+		}
+		if err := p.skipSeparator(); err != nil {
+			return nil, err
+		}
+		body, err := p.parseDoGroup()
+		if err != nil {
+			return nil, err
+		}
+		return &ArithForClause{Init: exprs[0], Cond: exprs[1], Post: exprs[2], Body: body}, nil
+	}
+
+	if tok.kind != tokWord || !isValidName(wordText(tok.word)) || isQuotedWord(tok.word) {
+		return nil, p.unexpected(tok)
+	}
+	p.advance()
+	clause := &ForClause{Name: wordText(tok.word)}
+
+	if tok, err = p.peek(); err != nil {
+		return nil, err
+	}
+	if tok.kind == tokOp && tok.val == ";" {
+		p.advance()
+	} else {
+		if err := p.skipNewlines(); err != nil {
+			return nil, err
+		}
+		if tok, err = p.peek(); err != nil {
+			return nil, err
+		}
+		if isReserved(tok, "in") {
+			p.advance()
+			clause.Words = []*Word{}
+			for {
+				if tok, err = p.peek(); err != nil {
+					return nil, err
+				}
+				if tok.kind != tokWord {
+					break
+				}
+				clause.Words = append(clause.Words, tok.word)
+				p.advance()
+			}
+			if err := p.skipSeparator(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if clause.Body, err = p.parseDoGroup(); err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
+
+// skipSeparator consumes an optional ';' or newline.
+func (p *parser) skipSeparator() error {
+	tok, err := p.peek()
+	if err != nil {
+		return err
+	}
+	if tok.kind == tokNewline || (tok.kind == tokOp && tok.val == ";") {
+		p.advance()
+	}
+	return nil
+}
+
+// splitArithFor splits the text of for ((init; cond; post)) at its
+// top-level semicolons.
+func splitArithFor(w *Word) []*Word {
+	exprs := []*Word{{}}
+	for _, part := range w.Parts {
+		lit, ok := part.(*Lit)
+		if !ok {
+			last := exprs[len(exprs)-1]
+			last.Parts = append(last.Parts, part)
+			continue
+		}
+		for i, text := range strings.Split(lit.Value, ";") {
+			if i > 0 {
+				exprs = append(exprs, &Word{})
+			}
+			if text != "" {
+				last := exprs[len(exprs)-1]
+				last.Parts = append(last.Parts, &Lit{Value: text})
+			}
+		}
+	}
+	return exprs
+}
+
+func (p *parser) parseCase() (*CaseClause, error) {
+	p.advance()
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tok.kind != tokWord {
+		return nil, p.unexpected(tok)
+	}
+	p.advance()
+	clause := &CaseClause{Word: tok.word}
+	if err := p.skipNewlines(); err != nil {
+		return nil, err
+	}
+	if err := p.expectReserved("in"); err != nil {
+		return nil, err
+	}
+
+	for {
+		if err := p.skipNewlines(); err != nil {
+			return nil, err
+		}
+		if tok, err = p.peek(); err != nil {
+			return nil, err
+		}
+		if isReserved(tok, "esac") {
+			p.advance()
+			return clause, nil
+		}
+		if tok.kind == tokOp && tok.val == "(" {
+			p.advance()
+		}
+
+		item := &CaseItem{Term: ";;"}
+		for {
+			if tok, err = p.peek(); err != nil {
+				return nil, err
+			}
+			if tok.kind != tokWord {
+				return nil, p.unexpected(tok)
+			}
+			item.Patterns = append(item.Patterns, tok.word)
+			p.advance()
+			if tok, err = p.peek(); err != nil {
+				return nil, err
+			}
+			if tok.kind != tokOp || tok.val != "|" {
+				break
+			}
+			p.advance()
+		}
+		if tok.kind != tokOp || tok.val != ")" {
+			return nil, p.unexpected(tok)
+		}
+		p.advance()
+
+		if item.Body, err = p.parseList(); err != nil {
+			return nil, err
+		}
+		if tok, err = p.peek(); err != nil {
+			return nil, err
+		}
+		switch {
+		case tok.kind == tokOp && (tok.val == ";;" || tok.val == ";&" || tok.val == ";;&"):
+			item.Term = tok.val
+			p.advance()
+		case !isReserved(tok, "esac"):
+			return nil, p.unexpected(tok)
+		}
+		clause.Items = append(clause.Items, item)
+	}
+}
+
+// parseRedirs reads the redirections following a compound command.
+func (p *parser) parseRedirs(redirs *[]*ReDirection) error {
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return err
+		}
+		if tok.kind != tokRedir {
+			return nil
+		}
+		redir, err := p.parseRedir()
+		if err != nil {
+			return err
+		}
+		*redirs = append(*redirs, redir)
+	}
+}
+
+func (p *parser) parseSimpleCommand() (*SimpleCommand, error) {
+	cmd := &SimpleCommand{}
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok.kind {
+		case tokWord:
+			p.advance()
+			if len(cmd.Args) == 0 {
+				if assign := parseAssign(tok.word); assign != nil {
+					cmd.Assigns = append(cmd.Assigns, assign)
+					continue
+				}
+			}
+			cmd.Args = append(cmd.Args, tok.word)
+
+		case tokRedir:
+			redir, err := p.parseRedir()
+			if err != nil {
+				return nil, err
+			}
+			cmd.Redirs = append(cmd.Redirs, redir)
+
+		default:
+			if len(cmd.Assigns) == 0 && len(cmd.Args) == 0 && len(cmd.Redirs) == 0 {
+				return nil, p.unexpected(tok)
+			}
+			return cmd, nil
+		}
+	}
+}
+
+// parseRedir reads a redirection operator and its target word. A
+// here-document is queued so the lexer reads its body after the next
+// newline.
+func (p *parser) parseRedir() (*ReDirection, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	p.advance()
+	target, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if target.kind != tokWord {
+		return nil, p.unexpected(target)
+	}
+	p.advance()
+
+	redir := &ReDirection{Fd: tok.fd, Type: tok.redir, Target: target.word}
+	if redir.Type == RedirHereDoc || redir.Type == RedirHereDocStrip {
+		p.lex.pending = append(p.lex.pending, redir)
+	}
+	return redir, nil
+}
+
+// parseAssign recognizes a word of the form NAME=value, where NAME and the
+// '=' are unquoted. It returns nil for any other word.
+func parseAssign(w *Word) *Assign {
+	if len(w.Parts) == 0 {
+		return nil
+	}
+	lit, ok := w.Parts[0].(*Lit)
+	if !ok {
+		return nil
+	}
+	eq := strings.IndexByte(lit.Value, '=')
+	if eq < 0 || !isValidName(lit.Value[:eq]) {
+		return nil
+	}
+
+	value := &Word{}
+	if rest := lit.Value[eq+1:]; rest != "" {
+		value.Parts = append(value.Parts, &Lit{Value: rest})
+	}
+	value.Parts = append(value.Parts, w.Parts[1:]...)
+	return &Assign{Name: lit.Value[:eq], Value: value}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"unicode"
+)
+
+// patChar is one character of a shell pattern. Quoted characters always
+// match themselves.
+type patChar struct {
+	r      rune
+	quoted bool
+}
+
+func patternChars(parts []fieldPart) []patChar {
+	var chars []patChar
+	for _, p := range parts {
+		for _, r := range p.val {
+			chars = append(chars, patChar{r: r, quoted: p.quoted})
+		}
+	}
+	return chars
+}
+
+func isExtglobOp(r rune) bool {
+	return r == '?' || r == '*' || r == '+' || r == '@' || r == '!'
+}
+
+// hasMeta reports whether the characters contain an unquoted pattern
+// character or extglob group.
+func hasMeta(chars []patChar) bool {
+	for i, c := range chars {
+		if c.quoted {
+			continue
+		}
+		if c.r == '*' || c.r == '?' || c.r == '[' {
+			return true
+		}
+		if isExtglobOp(c.r) && i+1 < len(chars) && chars[i+1].r == '(' && !chars[i+1].quoted {
+			return true
+		}
+	}
+	return false
+}
+
+type patOptions struct {
+	extglob bool
+	nocase  bool
+}
+
+const (
+	patLit = iota
+	patAny
+	patStar
+	patClass
+	patExt
+)
+
+type patNode struct {
+	kind  int
+	r     rune
+	class *charClass
+	// op and alts describe an extglob group such as @(a|b).
+	op   rune
+	alts [][]patNode
+}
+
+// pattern is a compiled shell pattern. It is matched by backtracking rather
+// than translated to a regexp, since !(...) has no regexp equivalent.
+type pattern struct {
+	nodes  []patNode
+	nocase bool
+}
+
+func compilePattern(chars []patChar, opts patOptions) *pattern {
+	return &pattern{nodes: parsePattern(chars, opts.extglob), nocase: opts.nocase}
+}
+
+func parsePattern(chars []patChar, extglob bool) []patNode {
+	var nodes []patNode
+	for i := 0; i < len(chars); i++ {
+		c := chars[i]
+		if c.quoted {
+			nodes = append(nodes, patNode{kind: patLit, r: c.r})
+			continue
+		}
+
+		if extglob && isExtglobOp(c.r) && i+1 < len(chars) && chars[i+1].r == '(' && !chars[i+1].quoted {
+			if alts, n := parseExtglob(chars[i+1:]); n > 0 {
+				group := patNode{kind: patExt, op: c.r}
+				for _, alt := range alts {
+					group.alts = append(group.alts, parsePattern(alt, extglob))
+				}
+				nodes = append(nodes, group)
+				i += n
+				continue
+			}
+		}
+
+		switch c.r {
+		case '*':
+			if len(nodes) == 0 || nodes[len(nodes)-1].kind != patStar {
+				nodes = append(nodes, patNode{kind: patStar})
+			}
+		case '?':
+			nodes = append(nodes, patNode{kind: patAny})
+		case '[':
+			if class, n := parseBracket(chars[i:]); n > 0 {
+				nodes = append(nodes, patNode{kind: patClass, class: class})
+				i += n - 1
+				continue
+			}
+			nodes = append(nodes, patNode{kind: patLit, r: c.r})
+		default:
+			nodes = append(nodes, patNode{kind: patLit, r: c.r})
+		}
+	}
+	return nodes
+}
+
+// parseExtglob splits the group starting at chars[0] == '(' into its
+// '|'-separated alternatives. It returns the number of characters used, or
+// 0 if the group is not closed.
+func parseExtglob(chars []patChar) ([][]patChar, int) {
+	var alts [][]patChar
+	depth := 0
+	start := 1
+	for i, c := range chars {
+		if c.quoted {
+			continue
+		}
+		switch c.r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return append(alts, chars[start:i]), i + 1
+			}
+		case '|':
+			if depth == 1 {
+				alts = append(alts, chars[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return nil, 0
+}
+
+type charClass struct {
+	negate bool
+	ranges [][2]rune
+	named  []string
+}
+
+// parseBracket parses a bracket expression starting at chars[0] == '['. It
+// returns the number of characters used, or 0 if the bracket is not closed
+// and so matches a literal '['.
+func parseBracket(chars []patChar) (*charClass, int) {
+	class := &charClass{}
+	i := 1
+	if i < len(chars) && !chars[i].quoted && (chars[i].r == '!' || chars[i].r == '^') {
+		class.negate = true
+		i++
+	}
+
+	for first := true; i < len(chars); i, first = i+1, false {
+		c := chars[i]
+		if !c.quoted && c.r == ']' && !first {
+			return class, i + 1
+		}
+
+		if !c.quoted && c.r == '[' && i+1 < len(chars) && chars[i+1].r == ':' {
+			end := -1
+			for j := i + 2; j+1 < len(chars); j++ {
+				if chars[j].r == ':' && chars[j+1].r == ']' {
+					end = j
+					break
+				}
+			}
+			if end >= 0 {
+				class.named = append(class.named, charsText(chars[i+2:end]))
+				i = end + 1
+				continue
+			}
+		}
+
+		lo, hi := c.r, c.r
+		if i+2 < len(chars) && chars[i+1].r == '-' && !chars[i+1].quoted && (chars[i+2].quoted || chars[i+2].r != ']') {
+			hi = chars[i+2].r
+			i += 2
+		}
+		class.ranges = append(class.ranges, [2]rune{lo, hi})
+	}
+	return nil, 0
+}
+
+func (c *charClass) matches(r rune, nocase bool) bool {
+	found := c.contains(r)
+	if !found && nocase {
+		found = c.contains(unicode.ToLower(r)) || c.contains(unicode.ToUpper(r))
+	}
+	return found != c.negate
+}
+
+func (c *charClass) contains(r rune) bool {
+	for _, rg := range c.ranges {
+		if r >= rg[0] && r <= rg[1] {
+			return true
+		}
+	}
+	for _, name := range c.named {
+		if namedClassMatches(name, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func namedClassMatches(name string, r rune) bool {
+	switch name {
+	case "alpha":
+		return unicode.IsLetter(r)
+	case "digit":
+		return r >= '0' && r <= '9'
+	case "alnum":
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	case "upper":
+		return unicode.IsUpper(r)
+	case "lower":
+		return unicode.IsLower(r)
+	case "space":
+		return unicode.IsSpace(r)
+	case "blank":
+		return r == ' ' || r == '\t'
+	case "punct":
+		return unicode.IsPunct(r) || unicode.IsSymbol(r)
+	case "xdigit":
+		return unicode.Is(unicode.ASCII_Hex_Digit, r)
+	case "cntrl":
+		return unicode.IsControl(r)
+	case "print":
+		return unicode.IsPrint(r)
+	case "graph":
+		return unicode.IsGraphic(r) && !unicode.IsSpace(r)
+	}
+	return false
+}
+
+func (p *pattern) match(s string) bool {
+	return p.matchNodes(p.nodes, []rune(s))
+}
+
+func (p *pattern) equal(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	return p.nocase && unicode.ToLower(a) == unicode.ToLower(b)
+}
+
+func (p *pattern) matchNodes(nodes []patNode, s []rune) bool {
+	for len(nodes) > 0 {
+		n := nodes[0]
+		switch n.kind {
+		case patLit:
+			if len(s) == 0 || !p.equal(n.r, s[0]) {
+				return false
+			}
+		case patAny:
+			if len(s) == 0 {
+				return false
+			}
+		case patClass:
+			if len(s) == 0 || !n.class.matches(s[0], p.nocase) {
+				return false
+			}
+		case patStar:
+			rest := nodes[1:]
+			if len(rest) == 0 {
+				return true
+			}
+			for k := 0; k <= len(s); k++ {
+				if p.matchNodes(rest, s[k:]) {
+					return true
+				}
+			}
+			return false
+		case patExt:
+			return p.matchExtglob(n, nodes[1:], s)
+		}
+		nodes = nodes[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+func (p *pattern) matchAlts(alts [][]patNode, s []rune) bool {
+	for _, alt := range alts {
+		if p.matchNodes(alt, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchExtglob matches the group n followed by rest against s, trying every
+// split point between the two.
+func (p *pattern) matchExtglob(n patNode, rest []patNode, s []rune) bool {
+	switch n.op {
+	case '@', '?':
+		if n.op == '?' && p.matchNodes(rest, s) {
+			return true
+		}
+		for k := 0; k <= len(s); k++ {
+			if p.matchAlts(n.alts, s[:k]) && p.matchNodes(rest, s[k:]) {
+				return true
+			}
+		}
+	case '*':
+		return p.matchRepeat(n, rest, s, false)
+	case '+':
+		return p.matchRepeat(n, rest, s, true)
+	case '!':
+		for k := 0; k <= len(s); k++ {
+			if !p.matchAlts(n.alts, s[:k]) && p.matchNodes(rest, s[k:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchRepeat matches zero (or, with atLeastOne, one) or more repetitions of
+// the group n followed by rest.
+func (p *pattern) matchRepeat(n patNode, rest []patNode, s []rune, atLeastOne bool) bool {
+	if p.matchNodes(rest, s) && (!atLeastOne || p.matchAlts(n.alts, nil)) {
+		return true
+	}
+	for k := 1; k <= len(s); k++ {
+		if p.matchAlts(n.alts, s[:k]) && p.matchRepeat(n, rest, s[k:], false) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,63 +1,323 @@
 package main
 
 import (
-	"regexp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
 	"strings"
 )
 
 type RedirectionType int
 
 const (
-	RedirOut RedirectionType = iota
-	RedirOutAppend
-	RedirErr
-	RedirErrAppend
+	RedirOut          RedirectionType = iota // [n]>file
+	RedirClobber                             // [n]>|file
+	RedirOutAppend                           // [n]>>file
+	RedirIn                                  // [n]<file
+	RedirReadWrite                           // [n]<>file
+	RedirHereString                          // [n]<<<word
+	RedirHereDoc                             // [n]<<delim
+	RedirHereDocStrip                        // [n]<<-delim
+	RedirDupOut                              // [n]>&m, [n]>&-
+	RedirDupIn                               // [n]<&m, [n]<&-
+	RedirAll                                 // &>file
+	RedirAllAppend                           // &>>file
 )
 
-type RedirPattern struct {
-	Pattern *regexp.Regexp
-	Type    RedirectionType
+// redirOps maps the redirection operators to their types, longest first.
+var redirOps = []struct {
+	op  string
+	typ RedirectionType
+}{
+	{"&>>", RedirAllAppend},
+	{"<<<", RedirHereString},
+	{"<<-", RedirHereDocStrip},
+	{"&>", RedirAll},
+	{">>", RedirOutAppend},
+	{">&", RedirDupOut},
+	{">|", RedirClobber},
+	{"<<", RedirHereDoc},
+	{"<&", RedirDupIn},
+	{"<>", RedirReadWrite},
+	{">", RedirOut},
+	{"<", RedirIn},
 }
 
+// maxFd is the highest descriptor a redirection may use, the usual limit
+// on open files. The descriptor table is a slice indexed by number when a
+// command is started.
+const maxFd = 1023
+
+// defaultFd is the descriptor an operator redirects when no number is
+// written before it.
+func (t RedirectionType) defaultFd() int {
+	switch t {
+	case RedirIn, RedirReadWrite, RedirHereString, RedirHereDoc, RedirHereDocStrip, RedirDupIn:
+		return 0
+	}
+	return 1
+}
+
+// isOutput reports whether the operator opens a file for writing only.
+func (t RedirectionType) isOutput() bool {
+	switch t {
+	case RedirOut, RedirClobber, RedirOutAppend, RedirAll, RedirAllAppend:
+		return true
+	}
+	return false
+}
+
+// ReDirection is a redirection operator applied to descriptor Fd with its
+// target word. For a here-document the target is the delimiter and Body
+// holds the text read from the following lines.
 type ReDirection struct {
-	Type     RedirectionType
-	FilePath string
+	Fd     int
+	Type   RedirectionType
+	Target *Word
+	Body   *Word
 }
 
-var redirectPatterns = []RedirPattern{
-	{regexp.MustCompile(`(^|\s+)2>>(\s+|$)`), RedirErrAppend},
-	{regexp.MustCompile(`(^|\s+)1>>(\s+|$)`), RedirOutAppend},
-	{regexp.MustCompile(`(^|\s+)>>(\s+|$)`), RedirOutAppend},
-	{regexp.MustCompile(`(^|\s+)2>(\s+|$)`), RedirErr},
-	{regexp.MustCompile(`(^|\s+)1>(\s+|$)`), RedirOut},
-	{regexp.MustCompile(`(^|\s+)>(\s+|$)`), RedirOut},
+// applyRedirections applies the redirections in order to a copy of the
+// descriptor table in s and returns the result, so that ">out 2>&1" and
+// "2>&1 >out" differ as they should. With multios set, a descriptor sent
+// to several outputs writes to all of them, as in zsh. The returned
+// function releases the opened files once the command finishes.
+func (sh *shell) applyRedirections(redirs []*ReDirection, s streams) (streams, func(), error) {
+	s, opened, err := sh.redirect(redirs, s)
+	if err != nil {
+		return s, nil, err
+	}
+	return s, func() { releaseFiles(opened, nil) }, nil
 }
 
-func extractRedirection(input string) (string, []ReDirection) {
-    var redirections []ReDirection
-	cmdString := input
+// ownedFile is a file opened by redirections. A tee's pipe also has the
+// function that closes it and waits for the copy, and the files it copies
+// to.
+type ownedFile struct {
+	wait    func()
+	targets []*os.File
+}
 
-	for _, pattern := range redirectPatterns {
-		for {
-			match := pattern.Pattern.FindStringIndex(cmdString)
-			if match == nil {
-				break
-			}
+// redirect does the work of applyRedirections, returning the files it
+// opened instead of a function that releases them.
+func (sh *shell) redirect(redirs []*ReDirection, s streams) (streams, map[*os.File]*ownedFile, error) {
+	// On error the caller gets back the descriptors it passed, which are
+	// still open, to report the error on.
+	orig := s
+	opened := make(map[*os.File]*ownedFile)
+	// outputs holds the files each descriptor has been redirected to.
+	outputs := make(map[int][]*os.File)
+	setFd := func(fd int, file *os.File, output bool) {
+		s = s.withFd(fd, file)
+		switch {
+		case !output:
+			delete(outputs, fd)
+		case sh.options["multios"]:
+			outputs[fd] = append(outputs[fd], file)
+		default:
+			outputs[fd] = []*os.File{file}
+		}
+	}
 
-			parts := strings.SplitN(cmdString[match[0]:], " ", 3)
-			cmdString = cmdString[:match[0]]
+	for _, r := range redirs {
+		if r.Fd > maxFd {
+			releaseFiles(opened, nil)
+			return orig, nil, fmt.Errorf("%d: Bad file descriptor", r.Fd)
+		}
+		target := r.Target
+		if r.Body != nil {
+			target = r.Body
+		}
+		value, err := sh.expandWord(target)
+		if err != nil {
+			releaseFiles(opened, nil)
+			return orig, nil, err
+		}
 
-			var filename string
-			if len(parts) >= 2{
-				filename = strings.TrimSpace(parts[len(parts) - 1])
+		if r.Type == RedirDupOut || r.Type == RedirDupIn {
+			if value == "-" {
+				setFd(r.Fd, nil, false)
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil && r.Type == RedirDupOut && r.Fd == 1 {
+				// >&file is an old spelling of &>file.
+				r = &ReDirection{Fd: 1, Type: RedirAll, Target: r.Target}
+			} else {
+				if err != nil {
+					releaseFiles(opened, nil)
+					return orig, nil, fmt.Errorf("%s: ambiguous redirect", value)
+				}
+				file := s.fd(n)
+				if file == nil {
+					releaseFiles(opened, nil)
+					return orig, nil, fmt.Errorf("%d: Bad file descriptor", n)
+				}
+				setFd(r.Fd, file, r.Type == RedirDupOut)
+				continue
 			}
+		}
+
+		var file *os.File
+		switch {
+		case r.Type == RedirHereString:
+			file, err = hereDocument(value + "\n")
+		case r.Type == RedirHereDoc || r.Type == RedirHereDocStrip:
+			file, err = hereDocument(value)
+		case isSocketPath(value):
+			file, err = dialSocket(value)
+		case r.Type == RedirIn:
+			file, err = sh.openFile(value, os.O_RDONLY)
+		case r.Type == RedirReadWrite:
+			file, err = sh.openFile(value, os.O_CREATE|os.O_RDWR)
+		case r.Type == RedirOut || r.Type == RedirAll:
+			file, err = sh.openOutput(value)
+		case r.Type == RedirClobber:
+			file, err = sh.openFile(value, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+		case r.Type == RedirOutAppend || r.Type == RedirAllAppend:
+			file, err = sh.openFile(value, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+		}
+		if err != nil {
+			releaseFiles(opened, nil)
+			return orig, nil, err
+		}
+		opened[file] = &ownedFile{}
+
+		if r.Type == RedirAll || r.Type == RedirAllAppend {
+			setFd(1, file, true)
+			setFd(2, file, true)
+		} else {
+			setFd(r.Fd, file, r.Type.isOutput())
+		}
+	}
 
-			redirections = append(redirections, ReDirection {
-				Type: pattern.Type,
-				FilePath: filename,
-			})
+	for fd, files := range outputs {
+		if len(files) < 2 {
+			continue
 		}
+		w, wait, err := teeOutput(files)
+		if err != nil {
+			releaseFiles(opened, nil)
+			return orig, nil, err
+		}
+		s = s.withFd(fd, w)
+		opened[w] = &ownedFile{wait: wait, targets: files}
 	}
+	return s, opened, nil
+}
 
-	return strings.TrimSpace(cmdString), redirections
-}
\ No newline at end of file
+// releaseFiles closes the opened files that are not in live, and removes
+// them from opened. Tees are waited for first so that their output is
+// complete, and a tee that stays open keeps the files it copies to.
+func releaseFiles(opened map[*os.File]*ownedFile, live map[*os.File]bool) {
+	for f, o := range opened {
+		if o.wait != nil && !live[f] {
+			o.wait()
+			delete(opened, f)
+		}
+	}
+	keep := make(map[*os.File]bool, len(live))
+	for f := range live {
+		keep[f] = true
+	}
+	for _, o := range opened {
+		for _, t := range o.targets {
+			keep[t] = true
+		}
+	}
+	for f := range opened {
+		if !keep[f] {
+			f.Close()
+			delete(opened, f)
+		}
+	}
+}
+
+// teeOutput returns the write end of a pipe whose data is copied to every
+// file, and a function that closes it and waits for the copy to finish.
+func teeOutput(files []*os.File) (*os.File, func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	writers := make([]io.Writer, len(files))
+	for i, f := range files {
+		writers[i] = f
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.MultiWriter(writers...), r)
+		r.Close()
+		close(done)
+	}()
+	wait := func() {
+		w.Close()
+		<-done
+	}
+	return w, wait, nil
+}
+
+// openOutput opens a file for '>'. With noclobber set it refuses to
+// truncate an existing regular file; O_EXCL makes the check and the
+// creation of a new file one step.
+func (sh *shell) openOutput(path string) (*os.File, error) {
+	if !sh.options["noclobber"] {
+		return sh.openFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	}
+	if info, err := os.Stat(sh.abs(path)); err == nil && !info.Mode().IsRegular() {
+		return sh.openFile(path, os.O_WRONLY)
+	}
+	file, err := sh.openFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("%s: cannot overwrite existing file", path)
+	}
+	return file, err
+}
+
+// isSocketPath reports whether path is one of the /dev/tcp/host/port and
+// /dev/udp/host/port names that bash emulates.
+func isSocketPath(path string) bool {
+	return strings.HasPrefix(path, "/dev/tcp/") || strings.HasPrefix(path, "/dev/udp/")
+}
+
+// dialSocket connects to the host and port named by a /dev/tcp or /dev/udp
+// path and returns the socket as a file, usable like any other descriptor.
+func dialSocket(path string) (*os.File, error) {
+	fields := strings.Split(strings.TrimPrefix(path, "/dev/"), "/")
+	if len(fields) != 3 || fields[1] == "" || fields[2] == "" {
+		return nil, fmt.Errorf("%s: invalid address", path)
+	}
+	conn, err := net.Dial(fields[0], net.JoinHostPort(fields[1], fields[2]))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// File returns a duplicate of the socket in blocking mode, which is
+	// what a child process expects to inherit.
+	sock, ok := conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported socket", path)
+	}
+	return sock.File()
+}
+
+// hereDocument returns the read end of a pipe that yields text. The text is
+// written from a goroutine so that input larger than the pipe buffer does
+// not block the shell; the writer gives up once the reader is closed.
+func hereDocument(text string) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		io.WriteString(w, text)
+		w.Close()
+	}()
+	return r, nil
+}
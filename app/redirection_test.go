@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPRedirection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// The server answers one line and then reports what it read after
+	// it, which is nothing once the shell closes the connection.
+	rest := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			rest <- err.Error()
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			rest <- err.Error()
+			return
+		}
+		fmt.Fprintf(conn, "pong %s", line)
+		data, err := io.ReadAll(r)
+		if err != nil {
+			rest <- err.Error()
+			return
+		}
+		rest <- string(data)
+	}()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	src := fmt.Sprintf("exec 3<>/dev/tcp/127.0.0.1/%d\necho ping >&3\nhead -n 1 <&3\nexec 3>&-\n", port)
+	if got, want := run(t, src), "pong ping\n"; got != want {
+		t.Errorf("read from socket: got %q, want %q", got, want)
+	}
+	if got := <-rest; got != "" {
+		t.Errorf("after closing fd 3 the server read %q, want EOF", got)
+	}
+}
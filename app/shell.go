@@ -0,0 +1,212 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// shoptOptions are the options toggled by the shopt builtin.
+var shoptOptions = []string{
+	"dotglob", "extglob", "failglob", "globstar", "interactive_comments",
+	"nocaseglob", "nullglob",
+}
+
+// setOptions are the options toggled by set -o.
+var setOptions = []string{
+	"multios", "noclobber",
+}
+
+type variable struct {
+	value    string
+	exported bool
+}
+
+// shell holds the interpreter state shared by everything run from one
+// prompt.
+type shell struct {
+	lastStatus int
+	vars       map[string]*variable
+	options    map[string]bool
+
+	// dir is the working directory. Clones run in the same process, so
+	// relative paths are resolved against dir rather than handed to the
+	// OS as they are.
+	dir string
+	// toplevel is set for the shell itself as opposed to its clones. Only
+	// it mirrors its directory and exported variables into the process,
+	// which is what completion and PATH lookup consult.
+	toplevel bool
+
+	// io holds the streams of the command being run; command substitutions
+	// inherit its stdin and stderr.
+	io streams
+	// substStatus is the status of the last command substitution, which
+	// becomes the status of a command made only of assignments.
+	substStatus int
+	// files are the shell's own descriptors, which commands run from the
+	// prompt start with. exec without a command replaces them and bumps
+	// filesGen.
+	files    streams
+	filesGen int
+	// execFiles are the files exec opened for files, which are closed
+	// once no descriptor refers to them.
+	execFiles map[*os.File]*ownedFile
+	// procSubsts are the process substitutions started while expanding
+	// the current command.
+	procSubsts []*procSubst
+	// loopDepth is the number of loops being run, which bounds break and
+	// continue.
+	loopDepth int
+
+	funcs map[string]*FuncDef
+	// params are the positional parameters $1, $2, ...
+	params []string
+	// scopes has an entry for each function call being run, holding the
+	// variables that local shadowed. They are put back when the call
+	// returns, so a local is seen by the functions its function calls.
+	scopes []map[string]*variable
+}
+
+func newShell() *shell {
+	sh := &shell{
+		vars:     make(map[string]*variable),
+		funcs:    make(map[string]*FuncDef),
+		options:  map[string]bool{"extglob": true, "interactive_comments": true, "multios": true},
+		io:       stdStreams(),
+		files:    stdStreams(),
+		toplevel: true,
+	}
+	sh.dir, _ = os.Getwd()
+	for _, kv := range os.Environ() {
+		name, value, ok := strings.Cut(kv, "=")
+		if ok && isValidName(name) {
+			sh.vars[name] = &variable{value: value, exported: true}
+		}
+	}
+	return sh
+}
+
+// clone returns a copy of the shell whose variables can change without
+// affecting sh.
+func (sh *shell) clone() *shell {
+	c := &shell{
+		lastStatus: sh.lastStatus,
+		vars:       make(map[string]*variable, len(sh.vars)),
+		options:    make(map[string]bool, len(sh.options)),
+		io:         sh.io,
+		files:      sh.files,
+		filesGen:   sh.filesGen,
+		dir:        sh.dir,
+		loopDepth:  sh.loopDepth,
+		funcs:      make(map[string]*FuncDef, len(sh.funcs)),
+		params:     sh.params,
+		scopes:     make([]map[string]*variable, len(sh.scopes)),
+	}
+	for name, on := range sh.options {
+		c.options[name] = on
+	}
+	for name, fn := range sh.funcs {
+		c.funcs[name] = fn
+	}
+	// The copy never returns from the calls it was made in, so it only
+	// needs somewhere for local to record what it shadows.
+	for i := range c.scopes {
+		c.scopes[i] = make(map[string]*variable)
+	}
+	for name, v := range sh.vars {
+		copied := *v
+		c.vars[name] = &copied
+	}
+	return c
+}
+
+func (sh *shell) lookupVar(name string) (string, bool) {
+	if v, ok := sh.vars[name]; ok {
+		return v.value, true
+	}
+	return "", false
+}
+
+func (sh *shell) setVar(name, value string) {
+	v, ok := sh.vars[name]
+	if !ok {
+		v = &variable{}
+		sh.vars[name] = v
+	}
+	v.value = value
+	if v.exported {
+		sh.syncEnv(name)
+	}
+}
+
+func (sh *shell) exportVar(name string) {
+	v, ok := sh.vars[name]
+	if !ok {
+		v = &variable{}
+		sh.vars[name] = v
+	}
+	v.exported = true
+	sh.syncEnv(name)
+}
+
+func (sh *shell) unsetVar(name string) {
+	v, ok := sh.vars[name]
+	if !ok {
+		return
+	}
+	delete(sh.vars, name)
+	if v.exported {
+		sh.syncEnv(name)
+	}
+}
+
+// syncEnv mirrors an exported variable into the process environment, which
+// is what findExecPath and the completer consult.
+func (sh *shell) syncEnv(name string) {
+	if !sh.toplevel {
+		return
+	}
+	if v, ok := sh.vars[name]; ok && v.exported {
+		os.Setenv(name, v.value)
+	} else {
+		os.Unsetenv(name)
+	}
+	if name == "PATH" {
+		clearExecPathCache()
+		completionTrie = nil
+	}
+}
+
+// abs resolves path against the shell's working directory.
+func (sh *shell) abs(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return joinPath(sh.dir, path)
+}
+
+// openFile is os.OpenFile for a path relative to the shell's working
+// directory. Errors still name the path as written.
+func (sh *shell) openFile(path string, flag int) (*os.File, error) {
+	file, err := os.OpenFile(sh.abs(path), flag, 0644)
+	if pathErr, ok := err.(*fs.PathError); ok {
+		pathErr.Path = path
+	}
+	return file, err
+}
+
+// environ returns the environment for a child process: every exported
+// variable plus the NAME=value pairs in extra.
+func (sh *shell) environ(extra []string) []string {
+	var env []string
+	for name, v := range sh.vars {
+		if v.exported {
+			env = append(env, name+"="+v.value)
+		}
+	}
+	sort.Strings(env)
+	return append(env, extra...)
+}